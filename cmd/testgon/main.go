@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/syohex/testgon/generator"
+	"github.com/syohex/testgon/runner"
+	"github.com/syohex/testgon/template"
+)
+
+// Exit status of testgon command
+const (
+	exitSuccess = iota
+	exitUsage
+	exitConfigError
+	exitSyntaxError
+	exitGenerateError
+	exitTestFailure
+
+	exitInterrupted = 130
+)
+
+const usageMessage = `Usage: testgon [options] template.tt... [options]
+
+Options:
+  -c config.json   configuration file (default: config.json)
+  -I dir           add directory to include search path(repeatable)
+  --trace-includes print file which each @include is resolved to
+  --int-only       generate integer tests only
+  --float-only     generate floating point tests only
+  --run            compile and run generated tests
+  --help           show this message
+
+Options can be given after templates. Arguments after "--" are templates
+even if they start with "-".
+
+Files of @include are searched in directory of the including file, in
+directories of -I in order, in "include_paths" of configuration file in
+order(relative to the configuration file), and then in directory of the
+template.
+
+Exit status:
+  0  success
+  1  invalid command line
+  2  configuration error
+  3  error in template
+  4  failed to generate test suite
+  5  some generated tests failed(with --run)
+`
+
+func usage() {
+	fmt.Fprint(os.Stderr, usageMessage)
+}
+
+// stringList is value of flag which can be specified multiple times
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ", ")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+type options struct {
+	param    generator.Param
+	run      bool
+	patterns []string
+}
+
+func parseArgs(args []string) (*options, error) {
+	opts := new(options)
+	param := &opts.param
+
+	flags := flag.NewFlagSet("testgon", flag.ContinueOnError)
+	flags.Usage = func() {}
+	flags.StringVar(&param.File, "c", "config.json", "configuration file")
+	flags.Var((*stringList)(&param.IncludePaths), "I", "include search path")
+	flags.BoolVar(&param.TraceIncludes, "trace-includes", false, "print resolved include files")
+	flags.BoolVar(&param.IntOnly, "int-only", false, "generate integer tests only")
+	flags.BoolVar(&param.FloatOnly, "float-only", false, "generate floating point tests only")
+	flags.BoolVar(&param.Help, "help", false, "show help message")
+	flags.BoolVar(&opts.run, "run", false, "compile and run generated tests")
+
+	// Options may follow templates, so parsing is restarted after each
+	// template. Arguments after '--' are templates.
+	opts.patterns = make([]string, 0)
+	rest := args
+	for {
+		if err := flags.Parse(rest); err != nil {
+			return nil, err
+		}
+
+		parsed := len(rest) - len(flags.Args())
+		rest = flags.Args()
+		if parsed > 0 && args[len(args)-len(rest)-1] == "--" {
+			opts.patterns = append(opts.patterns, rest...)
+			break
+		}
+
+		if len(rest) == 0 {
+			break
+		}
+		opts.patterns = append(opts.patterns, rest[0])
+		rest = rest[1:]
+	}
+
+	if param.IntOnly && param.FloatOnly {
+		return nil, fmt.Errorf("--int-only and --float-only are exclusive")
+	}
+
+	return opts, nil
+}
+
+func skipOptionName(param generator.Param) string {
+	if param.IntOnly {
+		return "--int-only"
+	}
+
+	return "--float-only"
+}
+
+func exitStatus(err error) int {
+	var patternErr *generator.PatternError
+	if errors.As(err, &patternErr) {
+		return exitUsage
+	}
+
+	var syntaxErr *template.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return exitSyntaxError
+	}
+
+	// Errors in template have position. Failures of reading or writing
+	// files are not template errors even if they have position.
+	var templateErr *template.Error
+	var pathErr *os.PathError
+	if errors.As(err, &templateErr) && !errors.As(err, &pathErr) {
+		return exitSyntaxError
+	}
+
+	return exitGenerateError
+}
+
+// printError prints error in template like compilers.
+//
+//	In file included from main.tt:3:
+//	sub.tt:12:5: error: '$foo' is not defined macro
+//	@file a.c $foo() @file_
+//	          ^
+func printError(w io.Writer, err error) {
+	var templateErr *template.Error
+	if !errors.As(err, &templateErr) {
+		fmt.Fprintf(w, "testgon: %s\n", err)
+		return
+	}
+
+	for _, include := range templateErr.Includes {
+		fmt.Fprintf(w, "In file included from %s:%d:\n", include.File, include.Line)
+	}
+	fmt.Fprintf(w, "%s: error: %s\n", templateErr.Position(), templateErr.Message)
+	fmt.Fprint(w, templateErr.Excerpt())
+}
+
+func run(args []string) int {
+	opts, err := parseArgs(args)
+	if err == flag.ErrHelp {
+		usage()
+		return exitSuccess
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "testgon: %s\n", err)
+		usage()
+		return exitUsage
+	}
+
+	if opts.param.Help {
+		usage()
+		return exitSuccess
+	}
+
+	if len(opts.patterns) == 0 {
+		fmt.Fprintln(os.Stderr, "testgon: template files are not specified")
+		usage()
+		return exitUsage
+	}
+
+	gen, err := generator.New(opts.param)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "testgon: %s: %s\n", opts.param.File, err)
+		return exitConfigError
+	}
+
+	if err := gen.Run(opts.patterns); err != nil {
+		printError(os.Stderr, err)
+		return exitStatus(err)
+	}
+
+	if gen.Skipped > 0 {
+		fmt.Printf("%d files are skipped by %s\n", gen.Skipped, skipOptionName(opts.param))
+	}
+
+	if !opts.run {
+		return exitSuccess
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	results, err := runner.New(gen.Config).RunContext(ctx)
+	if err == context.Canceled {
+		runner.Report(os.Stdout, results)
+		fmt.Fprintln(os.Stderr, "testgon: interrupted")
+		return exitInterrupted
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "testgon: %s\n", err)
+		return exitGenerateError
+	}
+
+	runner.Report(os.Stdout, results)
+	if runner.Failed(results) {
+		return exitTestFailure
+	}
+
+	return exitSuccess
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
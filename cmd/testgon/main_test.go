@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/syohex/testgon/generator"
+	"github.com/syohex/testgon/template"
+)
+
+func TestParseArgs(t *testing.T) {
+	args := []string{"-c", "target.json", "--int-only", "--run", "-I", "inc", "-I", "lib",
+		"--trace-includes", "a.tt", "b/*.tt"}
+	opts, err := parseArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	param := opts.param
+
+	if param.File != "target.json" {
+		t.Errorf("'-c' option is not set(got=%s)", param.File)
+	}
+
+	if !param.IntOnly || param.FloatOnly {
+		t.Error("'--int-only' option is not set")
+	}
+
+	if !opts.run {
+		t.Error("'--run' option is not set")
+	}
+
+	if len(param.IncludePaths) != 2 || param.IncludePaths[0] != "inc" || param.IncludePaths[1] != "lib" {
+		t.Errorf("'-I' options are not set in order(got=%v)", param.IncludePaths)
+	}
+
+	if !param.TraceIncludes {
+		t.Error("'--trace-includes' option is not set")
+	}
+
+	patterns := opts.patterns
+	if len(patterns) != 2 || patterns[0] != "a.tt" || patterns[1] != "b/*.tt" {
+		t.Errorf("template patterns are not set(got=%v)", patterns)
+	}
+}
+
+func TestParseArgsOptionsAfterTemplates(t *testing.T) {
+	opts, err := parseArgs([]string{"a.tt", "--int-only", "b.tt", "-I", "inc", "--", "-c.tt", "--run"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !opts.param.IntOnly || opts.run {
+		t.Errorf("options after templates are not parsed(int-only=%v, run=%v)", opts.param.IntOnly, opts.run)
+	}
+
+	if len(opts.param.IncludePaths) != 1 || opts.param.IncludePaths[0] != "inc" {
+		t.Errorf("'-I' option after template is not set(got=%v)", opts.param.IncludePaths)
+	}
+
+	expected := []string{"a.tt", "b.tt", "-c.tt", "--run"}
+	if len(opts.patterns) != len(expected) {
+		t.Fatalf("Expected %v but got %v", expected, opts.patterns)
+	}
+
+	for i := range expected {
+		if opts.patterns[i] != expected[i] {
+			t.Errorf("Expected %v but got %v", expected, opts.patterns)
+			break
+		}
+	}
+}
+
+func TestParseArgsDefaultConfig(t *testing.T) {
+	opts, err := parseArgs([]string{"a.tt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.param.File != "config.json" {
+		t.Errorf("Default config file is '%s' not 'config.json'", opts.param.File)
+	}
+}
+
+func TestParseArgsExclusiveOptions(t *testing.T) {
+	if _, err := parseArgs([]string{"--int-only", "--float-only"}); err == nil {
+		t.Error("'--int-only' and '--float-only' are specified but error is not returned")
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	if status := exitStatus(&template.SyntaxError{Line: 1}); status != exitSyntaxError {
+		t.Errorf("Expected exit status %d for syntax error(got=%d)", exitSyntaxError, status)
+	}
+
+	wrapped := &template.Error{File: "a.tt", Line: 1, Err: &template.SyntaxError{Line: 1}}
+	if status := exitStatus(wrapped); status != exitSyntaxError {
+		t.Errorf("Expected exit status %d for syntax error in template(got=%d)", exitSyntaxError, status)
+	}
+
+	if status := exitStatus(&generator.PatternError{Pattern: "*.tt"}); status != exitUsage {
+		t.Errorf("Expected exit status %d for unmatched pattern(got=%d)", exitUsage, status)
+	}
+
+	if status := exitStatus(errors.New("failed")); status != exitGenerateError {
+		t.Errorf("Expected exit status %d for other error(got=%d)", exitGenerateError, status)
+	}
+}
+
+// parseTemplates writes files into temporary directory and parses the first
+// one
+func parseTemplates(t *testing.T, files [][2]string) error {
+	dir, err := ioutil.TempDir("", "testgon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, file := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, file[0]), []byte(file[1]), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	parser := template.NewParser(filepath.Join(dir, "out"), nil)
+	parser.Warnings = ioutil.Discard
+	return parser.Parse(filepath.Join(dir, files[0][0]))
+}
+
+func TestExitStatusOfTemplateErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files [][2]string
+	}{
+		{"unknown section", [][2]string{{"a.tt", "@foo\n@foo_\n"}}},
+		{"invalid @def", [][2]string{{"a.tt", "@def $f($a, b)\n$a\n@def_\n"}}},
+		{"include cycle", [][2]string{{"a.tt", "@include b.tt @include_\n"}, {"b.tt", "@include a.tt @include_\n"}}},
+		{"bad @if", [][2]string{{"a.tt", "@if 1 +\n@if_\n"}}},
+		{"missing end", [][2]string{{"a.tt", "@def $a\n1\n"}}},
+	}
+
+	for _, test := range tests {
+		err := parseTemplates(t, test.files)
+		if err == nil {
+			t.Errorf("%s: error is not returned", test.name)
+			continue
+		}
+
+		if status := exitStatus(err); status != exitSyntaxError {
+			t.Errorf("%s: Expected exit status %d but got %d(%v)", test.name, exitSyntaxError, status, err)
+		}
+	}
+}
+
+func TestExitStatusOfOutputError(t *testing.T) {
+	// 'd' can't be created because 'out' is regular file
+	err := parseTemplates(t, [][2]string{{"a.tt", "@dir d\n@dir_\n"}, {"out", ""}})
+	if err == nil {
+		t.Fatal("error is not returned")
+	}
+
+	if status := exitStatus(err); status != exitGenerateError {
+		t.Errorf("Expected exit status %d but got %d(%v)", exitGenerateError, status, err)
+	}
+}
+
+func TestRunWithoutTemplates(t *testing.T) {
+	if status := run([]string{}); status != exitUsage {
+		t.Errorf("Expected exit status %d without templates(got=%d)", exitUsage, status)
+	}
+}
+
+func TestPrintError(t *testing.T) {
+	err := &template.Error{
+		File:     "sub.tt",
+		Line:     12,
+		Column:   11,
+		Includes: []template.Position{{File: "main.tt", Line: 3}},
+		Source:   "@file a.c $foo() @file_",
+		Message:  "'$foo' is not defined macro",
+	}
+
+	var buf bytes.Buffer
+	printError(&buf, err)
+
+	expected := `In file included from main.tt:3:
+sub.tt:12:11: error: '$foo' is not defined macro
+@file a.c $foo() @file_
+          ^
+`
+	if buf.String() != expected {
+		t.Errorf("Expected %q but got %q", expected, buf.String())
+	}
+
+	buf.Reset()
+	printError(&buf, errors.New("failed"))
+	if buf.String() != "testgon: failed\n" {
+		t.Errorf("unexpected message for other error(got=%q)", buf.String())
+	}
+}
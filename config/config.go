@@ -7,6 +7,7 @@ import (
 	"os/exec"
 	"os"
 	"io/ioutil"
+	"path/filepath"
 )
 
 // Config describes Testgen configuration
@@ -19,28 +20,45 @@ type Config struct {
 	TestDir     string   `json:"testdir"`
 	CompileOnly bool     `json:"compile_only"`
 
-	Size integerTypeSize `json:"size"`
+	Size typeSize `json:"size"`
 
 	Timeout   int  `json:"timeout"`
 	Parallels int  `json:"parallels"`
-	Color     bool `json:color`
+	Color     bool `json:"color"`
 
 	Lang            string `json:"lang"`
 	Expect          string `json:"expect"`
 	Complement      int    `json:"complement"`
 	OutputOption    string `json:"output_option"`
 	OptionSeparator string `json:"option_separator"`
+	FileIndexStart  int    `json:"file_index_start"`
+	MaxMacroDepth   int    `json:"max_macro_depth"`
+
+	// IncludePaths are searched for '@include' after paths given by '-I'.
+	// Relative paths are relative to directory of configuration file.
+	IncludePaths []string `json:"include_paths"`
+
+	// Encodings of templates and generated files. (ex "shift_jis", "latin-1")
+	TemplateEncoding string `json:"template_encoding"`
+	OutputEncoding   string `json:"output_encoding"`
 
 	Temp *bool `json:"has_printf"`
 	HasPrintf bool
 }
 
-type integerTypeSize struct {
-	Char    int `json:"char"`
-	Short   int `json:"short"`
-	Int     int `json:"int"`
-	Long    int `json:"long"`
-	Pointer int `json:"pointer"`
+type typeSize struct {
+	Char     int `json:"char"`
+	Short    int `json:"short"`
+	Int      int `json:"int"`
+	Long     int `json:"long"`
+	LongLong int `json:"long_long"`
+	Int128   int `json:"int128"`
+	Pointer  int `json:"pointer"`
+
+	// Floating point formats. (ex "ieee754_single", "x87_extended")
+	Float      string `json:"float"`
+	Double     string `json:"double"`
+	LongDouble string `json:"long_double"`
 }
 
 func (conf *Config) checkMandatoryParameters() error {
@@ -57,7 +75,7 @@ func (conf *Config) checkMandatoryParameters() error {
 
 func (conf *Config) lookCommands() error {
 	if _, err := exec.LookPath(conf.Compiler); err != nil {
-		return fmt.Errorf("Compiler '%s' is not found in PATH")
+		return fmt.Errorf("Compiler '%s' is not found in PATH", conf.Compiler)
 	}
 
 	if conf.Simulator != "" {
@@ -69,7 +87,7 @@ func (conf *Config) lookCommands() error {
 	return nil
 }
 
-func (size *integerTypeSize) checkSizeParameter() error {
+func (size *typeSize) checkSizeParameter() error {
 	if size.Char == 0 {
 		return errors.New("'char' in 'size' is not specified")
 	}
@@ -102,9 +120,35 @@ func (conf *Config) validate() error {
 		return err
 	}
 
+	if conf.FileIndexStart < 0 {
+		return errors.New("'file_index_start' should not be negative")
+	}
+
+	if conf.MaxMacroDepth < 0 {
+		return errors.New("'max_macro_depth' should not be negative")
+	}
+
 	return nil
 }
 
+func (size *typeSize) setDefaultValue() {
+	if size.LongLong == 0 {
+		size.LongLong = 64
+	}
+
+	if size.Float == "" {
+		size.Float = "ieee754_single"
+	}
+
+	if size.Double == "" {
+		size.Double = "ieee754_double"
+	}
+
+	if size.LongDouble == "" {
+		size.LongDouble = size.Double
+	}
+}
+
 func (conf *Config) setDefaultValue() {
 	if conf.Lang == "" {
 		conf.Lang = "c"
@@ -134,6 +178,16 @@ func (conf *Config) setDefaultValue() {
 		conf.OptionSeparator = " "
 	}
 
+	if conf.TemplateEncoding == "" {
+		conf.TemplateEncoding = "utf-8"
+	}
+
+	if conf.OutputEncoding == "" {
+		conf.OutputEncoding = "utf-8"
+	}
+
+	conf.Size.setDefaultValue()
+
 	if conf.Temp == nil {
 		conf.HasPrintf = true // default value
 	} else {
@@ -152,7 +206,22 @@ func Parse(filename string) (*Config, error) {
 		return nil, err
 	}
 
-	return parseBytes(bytes)
+	config, err := parseBytes(bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	config.resolveIncludePaths(filepath.Dir(filename))
+	return config, nil
+}
+
+// resolveIncludePaths makes relative include paths relative to dir
+func (conf *Config) resolveIncludePaths(dir string) {
+	for i, path := range conf.IncludePaths {
+		if !filepath.IsAbs(path) {
+			conf.IncludePaths[i] = filepath.Join(dir, path)
+		}
+	}
 }
 
 // Parse configuration file
@@ -1,6 +1,9 @@
 package config
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -19,7 +22,11 @@ const sample1 = `
        "short": 16,
        "int": 32,
        "long": 64,
-       "pointer" : 64
+       "long_long": 128,
+       "pointer" : 64,
+       "float": "ieee754_single",
+       "double": "ieee754_double",
+       "long_double": "x87_extended"
   },
 
   "timeout": 5,
@@ -30,6 +37,11 @@ const sample1 = `
   "expect": "#OK#",
   "complement": 1,
   "option_separator": "--",
+  "file_index_start": 100,
+  "max_macro_depth": 32,
+  "include_paths": [ "include", "/usr/share/testgon" ],
+  "template_encoding": "shift_jis",
+  "output_encoding": "latin-1",
   "has_printf": false
 }
 `
@@ -83,10 +95,22 @@ func Test1(t *testing.T) {
 		t.Error("'size.long' parameter is not set")
 	}
 
+	if conf.Size.LongLong != 128 {
+		t.Error("'size.long_long' parameter is not set")
+	}
+
 	if conf.Size.Pointer != 64 {
 		t.Error("'size.pointer' parameter is not set")
 	}
 
+	if conf.Size.Float != "ieee754_single" || conf.Size.Double != "ieee754_double" {
+		t.Error("'size.float' or 'size.double' parameter is not set")
+	}
+
+	if conf.Size.LongDouble != "x87_extended" {
+		t.Error("'size.long_double' parameter is not set")
+	}
+
 	if conf.Timeout != 5 {
 		t.Errorf("'timeout' parameter is not set(timeout=%d)", conf.Timeout)
 	}
@@ -115,6 +139,23 @@ func Test1(t *testing.T) {
 		t.Error("'option_separator' parameter is not set")
 	}
 
+	if conf.FileIndexStart != 100 {
+		t.Error("'file_index_start' parameter is not set")
+	}
+
+	if conf.MaxMacroDepth != 32 {
+		t.Error("'max_macro_depth' parameter is not set")
+	}
+
+	if len(conf.IncludePaths) != 2 || conf.IncludePaths[0] != "include" ||
+		conf.IncludePaths[1] != "/usr/share/testgon" {
+		t.Errorf("'include_paths' parameter is not set(got=%v)", conf.IncludePaths)
+	}
+
+	if conf.TemplateEncoding != "shift_jis" || conf.OutputEncoding != "latin-1" {
+		t.Errorf("encoding parameters are not set(got=%s, %s)", conf.TemplateEncoding, conf.OutputEncoding)
+	}
+
 	if conf.HasPrintf != false {
 		t.Errorf("'has_printf' parameter is not set(got=%v)", conf.HasPrintf)
 	}
@@ -145,7 +186,7 @@ func TestDefaultValue(t *testing.T) {
 	}
 
 	if conf.Expect != "@OK@" {
-		t.Errorf("Default 'Expect' value is '%d' not '@OK@'", conf.Expect)
+		t.Errorf("Default 'Expect' value is '%s' not '@OK@'", conf.Expect)
 	}
 
 	if conf.Complement != 2 {
@@ -155,6 +196,22 @@ func TestDefaultValue(t *testing.T) {
 	if conf.HasPrintf != true {
 		t.Errorf("Default 'HasPrintf' value is '%v' not 'true'", conf.HasPrintf)
 	}
+
+	if conf.TemplateEncoding != "utf-8" || conf.OutputEncoding != "utf-8" {
+		t.Errorf("Default encodings are '%s' and '%s' not 'utf-8'", conf.TemplateEncoding, conf.OutputEncoding)
+	}
+
+	if conf.Size.LongLong != 64 {
+		t.Errorf("Default 'size.long_long' value is '%d' not '64'", conf.Size.LongLong)
+	}
+
+	if conf.Size.Float != "ieee754_single" {
+		t.Errorf("Default 'size.float' value is '%s' not 'ieee754_single'", conf.Size.Float)
+	}
+
+	if conf.Size.LongDouble != "ieee754_double" {
+		t.Errorf("Default 'size.long_double' value is '%s' not 'ieee754_double'", conf.Size.LongDouble)
+	}
 }
 
 func TestNotFoundCompiler(t *testing.T) {
@@ -265,3 +322,46 @@ func TestSizeParameter(t *testing.T) {
 		t.Error("'long' parameter can not be omitted")
 	}
 }
+
+func TestNegativeFileIndexStart(t *testing.T) {
+	jsonStr := `
+{
+  "compiler": "cc", "testdir": "testsuite",
+  "size": { "char": 8, "short": 16, "int": 32, "long": 64 },
+  "file_index_start": -1
+}
+`
+	if _, err := parseBytes([]byte(jsonStr)); err == nil {
+		t.Error("'file_index_start' is negative but error is not returned")
+	}
+}
+
+func TestParseRelativeIncludePaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testgon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jsonStr := `
+{
+  "compiler": "cc", "testdir": "testsuite",
+  "size": { "char": 8, "short": 16, "int": 32, "long": 64 },
+  "include_paths": [ "include", "/usr/share/testgon" ]
+}
+`
+	file := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(file, []byte(jsonStr), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := Parse(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(conf.IncludePaths) != 2 || conf.IncludePaths[0] != filepath.Join(dir, "include") ||
+		conf.IncludePaths[1] != "/usr/share/testgon" {
+		t.Errorf("relative include path is not resolved from config directory(got=%v)", conf.IncludePaths)
+	}
+}
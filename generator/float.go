@@ -0,0 +1,78 @@
+package generator
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/syohex/testgon/template/macro"
+)
+
+// floatFormat describes binary floating point format by parameters of
+// <float.h>. (ex FLT_MANT_DIG, FLT_MIN_EXP, FLT_MAX_EXP)
+type floatFormat struct {
+	mantDig    uint
+	minExp     int
+	maxExp     int
+	decimalDig int
+}
+
+var floatFormats = map[string]floatFormat{
+	"ieee754_single": {mantDig: 24, minExp: -125, maxExp: 128, decimalDig: 9},
+	"ieee754_double": {mantDig: 53, minExp: -1021, maxExp: 1024, decimalDig: 17},
+	"x87_extended":   {mantDig: 64, minExp: -16381, maxExp: 16384, decimalDig: 21},
+	"ieee754_quad":   {mantDig: 113, minExp: -16381, maxExp: 16384, decimalDig: 36},
+}
+
+func lookupFloatFormat(name string) (floatFormat, error) {
+	format, ok := floatFormats[name]
+	if !ok {
+		return format, fmt.Errorf("Unknown floating point format '%s'", name)
+	}
+
+	return format, nil
+}
+
+func (format floatFormat) literal(value *big.Float, typeName string) string {
+	return value.Text('e', format.decimalDig-1) + typeSuffix(typeName)
+}
+
+// maxValue is (1 - 2^-p) * 2^emax
+func (format floatFormat) maxValue(typeName string) string {
+	one := new(big.Float).SetPrec(format.mantDig).SetInt64(1)
+	ulp := new(big.Float).SetMantExp(one, -int(format.mantDig))
+	value := new(big.Float).SetPrec(format.mantDig).Sub(one, ulp)
+	value.SetMantExp(value, format.maxExp)
+	return format.literal(value, typeName)
+}
+
+// minValue is minimum normalized positive value, 2^(emin-1)
+func (format floatFormat) minValue(typeName string) string {
+	one := new(big.Float).SetPrec(format.mantDig).SetInt64(1)
+	return format.literal(new(big.Float).SetMantExp(one, format.minExp-1), typeName)
+}
+
+// epsilon is difference between 1 and the least value greater than 1, 2^(1-p)
+func (format floatFormat) epsilon(typeName string) string {
+	one := new(big.Float).SetPrec(format.mantDig).SetInt64(1)
+	return format.literal(new(big.Float).SetMantExp(one, 1-int(format.mantDig)), typeName)
+}
+
+var floatMacroPrefixes = map[string]string{
+	"float":       "FLT",
+	"double":      "DBL",
+	"long double": "LDBL",
+}
+
+func registerFloatTypeMacro(env map[string]*macro.Macro, typeName string, format floatFormat) {
+	prefix := "$" + floatMacroPrefixes[typeName]
+
+	values := map[string]string{
+		prefix + "MAX":     format.maxValue(typeName),
+		prefix + "MIN":     format.minValue(typeName),
+		prefix + "EPSILON": format.epsilon(typeName),
+	}
+
+	for name, value := range values {
+		env[name] = &macro.Macro{Name: name, Body: value}
+	}
+}
@@ -0,0 +1,52 @@
+package generator
+
+import (
+	"testing"
+)
+
+func TestFloatMaxValue(t *testing.T) {
+	single, _ := lookupFloatFormat("ieee754_single")
+	if got := single.maxValue("float"); got != "3.40282347e+38F" {
+		t.Errorf(`Expected: "3.40282347e+38F" but got %s`, got)
+	}
+
+	double, _ := lookupFloatFormat("ieee754_double")
+	if got := double.maxValue("double"); got != "1.7976931348623157e+308" {
+		t.Errorf(`Expected: "1.7976931348623157e+308" but got %s`, got)
+	}
+
+	extended, _ := lookupFloatFormat("x87_extended")
+	if got := extended.maxValue("long double"); got != "1.18973149535723176502e+4932L" {
+		t.Errorf(`Expected: "1.18973149535723176502e+4932L" but got %s`, got)
+	}
+}
+
+func TestFloatMinValue(t *testing.T) {
+	single, _ := lookupFloatFormat("ieee754_single")
+	if got := single.minValue("float"); got != "1.17549435e-38F" {
+		t.Errorf(`Expected: "1.17549435e-38F" but got %s`, got)
+	}
+
+	double, _ := lookupFloatFormat("ieee754_double")
+	if got := double.minValue("double"); got != "2.2250738585072014e-308" {
+		t.Errorf(`Expected: "2.2250738585072014e-308" but got %s`, got)
+	}
+}
+
+func TestFloatEpsilon(t *testing.T) {
+	single, _ := lookupFloatFormat("ieee754_single")
+	if got := single.epsilon("float"); got != "1.19209290e-07F" {
+		t.Errorf(`Expected: "1.19209290e-07F" but got %s`, got)
+	}
+
+	double, _ := lookupFloatFormat("ieee754_double")
+	if got := double.epsilon("double"); got != "2.2204460492503131e-16" {
+		t.Errorf(`Expected: "2.2204460492503131e-16" but got %s`, got)
+	}
+}
+
+func TestUnknownFloatFormat(t *testing.T) {
+	if _, err := lookupFloatFormat("vax_f"); err == nil {
+		t.Error("unknown format but error is not returned")
+	}
+}
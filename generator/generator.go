@@ -3,10 +3,12 @@ package generator
 import (
 	"errors"
 	"fmt"
-	"math"
+	"io"
+	"math/big"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/syohex/testgon/config"
@@ -15,10 +17,12 @@ import (
 )
 
 type Param struct {
-	File      string
-	Help      bool
-	IntOnly   bool
-	FloatOnly bool
+	File          string
+	Help          bool
+	IntOnly       bool
+	FloatOnly     bool
+	IncludePaths  []string
+	TraceIncludes bool
 }
 
 type Generator struct {
@@ -26,6 +30,17 @@ type Generator struct {
 	Help      bool
 	IntOnly   bool
 	FloatOnly bool
+
+	// IncludePaths are given by command line. They are searched before
+	// include paths in configuration.
+	IncludePaths []string
+
+	// IncludeTrace receives file which each '@include' is resolved to if it
+	// is not nil
+	IncludeTrace io.Writer
+
+	// Skipped is number of files which are excluded by IntOnly or FloatOnly
+	Skipped int
 }
 
 func New(param Param) (*Generator, error) {
@@ -34,16 +49,38 @@ func New(param Param) (*Generator, error) {
 		return nil, err
 	}
 
+	if err := checkFloatFormats(conf); err != nil {
+		return nil, err
+	}
+
+	if err := checkEncodings(conf); err != nil {
+		return nil, err
+	}
+
 	generator := &Generator{
-		Config:    conf,
-		Help:      param.Help,
-		IntOnly:   param.IntOnly,
-		FloatOnly: param.FloatOnly,
+		Config:       conf,
+		Help:         param.Help,
+		IntOnly:      param.IntOnly,
+		FloatOnly:    param.FloatOnly,
+		IncludePaths: param.IncludePaths,
+	}
+
+	if param.TraceIncludes {
+		generator.IncludeTrace = os.Stderr
 	}
 
 	return generator, nil
 }
 
+// PatternError is returned when template pattern matches no files
+type PatternError struct {
+	Pattern string
+}
+
+func (e *PatternError) Error() string {
+	return fmt.Sprintf("'%s' matches no template files", e.Pattern)
+}
+
 func expandPatterns(patterns []string) ([]string, error) {
 	files := make([]string, 0)
 	for _, pattern := range patterns {
@@ -52,6 +89,10 @@ func expandPatterns(patterns []string) ([]string, error) {
 			return nil, fmt.Errorf("Can't expand '%s'", pattern)
 		}
 
+		if len(expands) == 0 {
+			return nil, &PatternError{Pattern: pattern}
+		}
+
 		files = append(files, expands...)
 	}
 
@@ -70,24 +111,68 @@ func checkTemplateFileName(templates []string) error {
 	return nil
 }
 
+func checkFloatFormats(conf *config.Config) error {
+	for _, name := range []string{conf.Size.Float, conf.Size.Double, conf.Size.LongDouble} {
+		if _, err := lookupFloatFormat(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func checkEncodings(conf *config.Config) error {
+	for _, name := range []string{conf.TemplateEncoding, conf.OutputEncoding} {
+		if err := template.CheckEncoding(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (generator *Generator) generateTestSuite(templates []string) error {
-	env := generator.setPredefinedMacros()
+	env, err := generator.setPredefinedMacros()
+	if err != nil {
+		return err
+	}
 
 	outputDir := generator.Config.TestDir
-	if err := os.Mkdir(outputDir, 0755); err != nil {
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
 		return err
 	}
 
 	parser := template.NewParser(outputDir, env)
-	for _, template := range templates {
-		if err := parser.Parse(template); err != nil {
+	parser.SetFilenameIndex(generator.Config.FileIndexStart)
+	parser.MaxMacroDepth = generator.Config.MaxMacroDepth
+	parser.IncludePaths = generator.includePaths()
+	parser.IncludeTrace = generator.IncludeTrace
+	parser.TemplateEncoding = generator.Config.TemplateEncoding
+	parser.OutputEncoding = generator.Config.OutputEncoding
+	if generator.IntOnly {
+		parser.Skip = template.FLOAT_TEST
+	} else if generator.FloatOnly {
+		parser.Skip = template.INT_TEST
+	}
+
+	for _, file := range templates {
+		if err := parser.Parse(file); err != nil {
 			return err
 		}
 	}
 
+	generator.Skipped = parser.Skipped()
 	return nil
 }
 
+// includePaths returns include paths in order of search. Paths given by
+// command line precede paths in configuration.
+func (generator *Generator) includePaths() []string {
+	paths := make([]string, 0, len(generator.IncludePaths)+len(generator.Config.IncludePaths))
+	paths = append(paths, generator.IncludePaths...)
+	return append(paths, generator.Config.IncludePaths...)
+}
+
 func (generator *Generator) Run(patterns []string) error {
 	if patterns == nil {
 		return errors.New("Templete files are not specified")
@@ -109,18 +194,95 @@ func (generator *Generator) Run(patterns []string) error {
 	return nil
 }
 
-func (generator *Generator) setPredefinedMacros() map[string]*macro.Macro {
+func (generator *Generator) setPredefinedMacros() (map[string]*macro.Macro, error) {
 	size := generator.Config.Size
 	complement := generator.Config.Complement
 
 	env := make(map[string]*macro.Macro)
-	registerIntTypeMacro(env, "char", size.Char, complement)
-	registerIntTypeMacro(env, "short", size.Short, complement)
-	registerIntTypeMacro(env, "int", size.Int, complement)
-	registerIntTypeMacro(env, "long", size.Long, complement)
-	// should implement pointer type and 'float' and 'double'
+	macro.RegisterBuiltins(env)
+
+	intTypes := []intType{
+		{"char", size.Char},
+		{"short", size.Short},
+		{"int", size.Int},
+		{"long", size.Long},
+		{"long long", size.LongLong},
+	}
+	if size.Int128 != 0 {
+		intTypes = append(intTypes, intType{"__int128", size.Int128})
+	}
+
+	for _, t := range intTypes {
+		registerIntTypeMacro(env, t.name, t.width, complement)
+	}
+	registerTypeListMacros(env, intTypes)
+	registerConfigMacros(env, generator.Config)
+
+	if size.Pointer != 0 {
+		pointerType := pointerTypeName(size.Pointer, size.Int, size.Long, size.LongLong)
+		registerLimitMacro(env, "PTR", pointerType, size.Pointer, complement)
+	}
+
+	floatTypes := map[string]string{
+		"float":       size.Float,
+		"double":      size.Double,
+		"long double": size.LongDouble,
+	}
+	for typeName, formatName := range floatTypes {
+		format, err := lookupFloatFormat(formatName)
+		if err != nil {
+			return nil, err
+		}
+		registerFloatTypeMacro(env, typeName, format)
+	}
 
-	return env
+	return env, nil
+}
+
+// registerConfigMacros registers configuration values which are used in
+// conditions of '@if' sections. (ex @if $LONG == 64)
+//
+//	$CHAR, $SHORT, $INT, $LONG, $LLONG, $INT128, $POINTER    width of type
+//	$COMPLEMENT    1 or 2
+//	$LANG          language as string literal (ex "c")
+//	$HASPRINTF     1 if printf is available, otherwise 0
+func registerConfigMacros(env map[string]*macro.Macro, conf *config.Config) {
+	hasPrintf := 0
+	if conf.HasPrintf {
+		hasPrintf = 1
+	}
+
+	values := map[string]string{
+		"$CHAR":       strconv.Itoa(conf.Size.Char),
+		"$SHORT":      strconv.Itoa(conf.Size.Short),
+		"$INT":        strconv.Itoa(conf.Size.Int),
+		"$LONG":       strconv.Itoa(conf.Size.Long),
+		"$LLONG":      strconv.Itoa(conf.Size.LongLong),
+		"$INT128":     strconv.Itoa(conf.Size.Int128),
+		"$POINTER":    strconv.Itoa(conf.Size.Pointer),
+		"$COMPLEMENT": strconv.Itoa(conf.Complement),
+		"$LANG":       strconv.Quote(conf.Lang),
+		"$HASPRINTF":  strconv.Itoa(hasPrintf),
+	}
+
+	for name, value := range values {
+		env[name] = &macro.Macro{Name: name, Body: value}
+	}
+}
+
+// pointerTypeName returns integer type whose width is same as pointer. Its
+// suffix is used for literals of pointer width limits.
+func pointerTypeName(pointer int, intWidth int, long int, longLong int) string {
+	switch pointer {
+	case intWidth:
+		return "int"
+	case long:
+		return "long"
+	case longLong:
+		return "long long"
+	default:
+		return ""
+	}
 }
 
 func typeSuffix(typeName string) string {
@@ -138,27 +300,73 @@ func typeSuffix(typeName string) string {
 	}
 }
 
+// unsignedSuffix returns suffix of unsigned literal. Types narrower than
+// 'int' do not have 'U' like UCHAR_MAX and USHRT_MAX in <limits.h>.
+func unsignedSuffix(typeName string) string {
+	switch typeName {
+	case "char", "short", "__int128":
+		return ""
+	default:
+		return "U" + typeSuffix(typeName)
+	}
+}
+
+// maxLiteralWidth is width of the widest integer literal in C
+const maxLiteralWidth = 64
+
+// lowBits returns 2^bitWidth - 1
+func lowBits(bitWidth int) *big.Int {
+	value := new(big.Int).Lsh(big.NewInt(1), uint(bitWidth))
+	return value.Sub(value, big.NewInt(1))
+}
+
+// wideLiteral builds value wider than any integer literal from 64bit
+// chunks. (ex (((unsigned __int128)0x1ULL << 64) | 0x0ULL))
+func wideLiteral(typeName string, value *big.Int, signed bool) string {
+	chunks := make([]*big.Int, 0)
+	mask := lowBits(maxLiteralWidth)
+	for rest := new(big.Int).Set(value); rest.Sign() > 0; rest.Rsh(rest, maxLiteralWidth) {
+		chunks = append(chunks, new(big.Int).And(rest, mask))
+	}
+
+	top := len(chunks) - 1
+	expr := fmt.Sprintf("(unsigned %s)0x%xULL", typeName, chunks[top])
+	for i := top - 1; i >= 0; i-- {
+		expr = fmt.Sprintf("((%s << %d) | 0x%xULL)", expr, maxLiteralWidth, chunks[i])
+	}
+
+	if signed {
+		return fmt.Sprintf("((%s)%s)", typeName, expr)
+	}
+
+	return expr
+}
+
+func intLiteral(typeName string, value *big.Int, suffix string, signed bool) string {
+	if value.BitLen() > maxLiteralWidth {
+		return wideLiteral(typeName, value, signed)
+	}
+
+	return value.String() + suffix
+}
+
 func signedMaxValue(typeName string, bitWidth int) string {
-	suffix := typeSuffix(typeName)
-	width := float64(bitWidth)
-	return fmt.Sprintf("%.0f%s", math.Pow(2, (width-1))-1, suffix)
+	return intLiteral(typeName, lowBits(bitWidth-1), typeSuffix(typeName), true)
 }
 
+// signedMinValue of two's complement is written as (-MAX-1) because negated
+// literal of 2^(N-1) overflows its type. (ex (-9223372036854775807LL-1))
 func signedMinValue(typeName string, bitWidth int, complement int) string {
-	suffix := typeSuffix(typeName)
-
-	width := float64(bitWidth)
+	max := signedMaxValue(typeName, bitWidth)
 	if complement == 2 {
-		return fmt.Sprintf("%.0f%s", -math.Pow(2, (width-1)), suffix)
+		return fmt.Sprintf("(-%s-1)", max)
 	} else {
-		return fmt.Sprintf("%.0f%s", -math.Pow(2, (width-1))+1, suffix)
+		return "-" + max
 	}
 }
 
 func unsignedMaxValue(typeName string, bitWidth int) string {
-	suffix := typeSuffix(typeName)
-	width := float64(bitWidth)
-	return fmt.Sprintf("%.0f%s", math.Pow(2, width)-1, suffix)
+	return intLiteral(typeName, lowBits(bitWidth), unsignedSuffix(typeName), false)
 }
 
 const (
@@ -171,7 +379,20 @@ const (
 	MAX_VALUE = 1
 )
 
-func macroTypeName(typeName string, signed int, min int) string {
+var macroPrefixes = map[string]string{
+	"long long": "LLONG",
+	"__int128":  "INT128",
+}
+
+func macroPrefix(typeName string) string {
+	if prefix, ok := macroPrefixes[typeName]; ok {
+		return prefix
+	}
+
+	return strings.ToUpper(typeName)
+}
+
+func macroTypeName(prefix string, signed int, min int) string {
 	var unsignedPrefix string
 	if signed == UNSIGNED_TYPE {
 		unsignedPrefix = "U"
@@ -186,7 +407,7 @@ func macroTypeName(typeName string, signed int, min int) string {
 		suffix = "MAX"
 	}
 
-	return fmt.Sprintf("%s%s%s", unsignedPrefix, strings.ToUpper(typeName), suffix)
+	return fmt.Sprintf("%s%s%s", unsignedPrefix, prefix, suffix)
 }
 
 func registerIntTypeMacro(
@@ -194,18 +415,30 @@ func registerIntTypeMacro(
 	typeName string,
 	bitWidth int,
 	complement int,
+) {
+	registerLimitMacro(env, macroPrefix(typeName), typeName, bitWidth, complement)
+}
+
+// registerLimitMacro registers limits of integer type whose macro names
+// start with prefix. (ex $INTMIN, $UINTMAX)
+func registerLimitMacro(
+	env map[string]*macro.Macro,
+	prefix string,
+	typeName string,
+	bitWidth int,
+	complement int,
 ) {
 	signedMin := signedMinValue(typeName, bitWidth, complement)
 	signedMax := signedMaxValue(typeName, bitWidth)
 	unsignedMax := unsignedMaxValue(typeName, bitWidth)
 
-	signedMinName := macroTypeName(typeName, SIGNED_TYPE, MIN_VALUE)
-	signedMaxName := macroTypeName(typeName, SIGNED_TYPE, MAX_VALUE)
-	unsignedMinName := macroTypeName(typeName, UNSIGNED_TYPE, MIN_VALUE)
-	unsignedMaxName := macroTypeName(typeName, UNSIGNED_TYPE, MAX_VALUE)
+	signedMinName := "$" + macroTypeName(prefix, SIGNED_TYPE, MIN_VALUE)
+	signedMaxName := "$" + macroTypeName(prefix, SIGNED_TYPE, MAX_VALUE)
+	unsignedMinName := "$" + macroTypeName(prefix, UNSIGNED_TYPE, MIN_VALUE)
+	unsignedMaxName := "$" + macroTypeName(prefix, UNSIGNED_TYPE, MAX_VALUE)
 
 	env[signedMinName] = &macro.Macro{Name: signedMinName, Body: signedMin}
-	env[signedMaxName] = &macro.Macro{Name: signedMinName, Body: signedMax}
-	env[unsignedMinName] = &macro.Macro{Name: signedMinName, Body: "0"}
-	env[unsignedMaxName] = &macro.Macro{Name: signedMinName, Body: unsignedMax}
+	env[signedMaxName] = &macro.Macro{Name: signedMaxName, Body: signedMax}
+	env[unsignedMinName] = &macro.Macro{Name: unsignedMinName, Body: "0"}
+	env[unsignedMaxName] = &macro.Macro{Name: unsignedMaxName, Body: unsignedMax}
 }
@@ -2,6 +2,9 @@ package generator
 
 import (
 	"testing"
+
+	"github.com/syohex/testgon/config"
+	"github.com/syohex/testgon/template/macro"
 )
 
 func TestSignedMaxValue(t *testing.T) {
@@ -18,8 +21,8 @@ func TestSignedMaxValue(t *testing.T) {
 
 func TestSignedMinValue(t *testing.T) {
 	signedShortMin := signedMinValue(`short`, 16, 2)
-	if signedShortMin != "-32768" {
-		t.Errorf(`Expected: "-32768" but got %s`, signedShortMin)
+	if signedShortMin != "(-32767-1)" {
+		t.Errorf(`Expected: "(-32767-1)" but got %s`, signedShortMin)
 	}
 
 	signedShortMin2 := signedMinValue(`short`, 16, 1)
@@ -28,8 +31,13 @@ func TestSignedMinValue(t *testing.T) {
 	}
 
 	signedLongLongMin := signedMinValue(`long long`, 8, 2)
-	if signedLongLongMin != "-128LL" {
-		t.Errorf(`Expected: "128" but got %s`, signedLongLongMin)
+	if signedLongLongMin != "(-127LL-1)" {
+		t.Errorf(`Expected: "(-127LL-1)" but got %s`, signedLongLongMin)
+	}
+
+	signedLongLongMin = signedMinValue(`long long`, 64, 2)
+	if signedLongLongMin != "(-9223372036854775807LL-1)" {
+		t.Errorf(`Expected: "(-9223372036854775807LL-1)" but got %s`, signedLongLongMin)
 	}
 }
 
@@ -40,12 +48,149 @@ func TestUnSignedMaxValue(t *testing.T) {
 	}
 
 	unsignedLongMin := unsignedMaxValue(`long`, 16)
-	if unsignedLongMin != "65535L" {
-		t.Errorf(`Expected: "65535L" but got %s`, unsignedLongMin)
+	if unsignedLongMin != "65535UL" {
+		t.Errorf(`Expected: "65535UL" but got %s`, unsignedLongMin)
 	}
 
 	unsignedIntMin := unsignedMaxValue(`int`, 32)
-	if unsignedIntMin != "4294967295" {
-		t.Errorf(`Expected: "4294967295" but got %s`, unsignedIntMin)
+	if unsignedIntMin != "4294967295U" {
+		t.Errorf(`Expected: "4294967295U" but got %s`, unsignedIntMin)
+	}
+
+	unsignedLongLongMax := unsignedMaxValue(`long long`, 64)
+	if unsignedLongLongMax != "18446744073709551615ULL" {
+		t.Errorf(`Expected: "18446744073709551615ULL" but got %s`, unsignedLongLongMax)
+	}
+}
+
+func TestSignedMaxValue64(t *testing.T) {
+	signedLongMax := signedMaxValue(`long`, 64)
+	if signedLongMax != "9223372036854775807L" {
+		t.Errorf(`Expected: "9223372036854775807L" but got %s`, signedLongMax)
+	}
+}
+
+func TestInt128Value(t *testing.T) {
+	expected := "((__int128)(((unsigned __int128)0x7fffffffffffffffULL << 64) | 0xffffffffffffffffULL))"
+	if got := signedMaxValue(`__int128`, 128); got != expected {
+		t.Errorf(`Expected: "%s" but got %s`, expected, got)
+	}
+
+	expected = "(-" + expected + "-1)"
+	if got := signedMinValue(`__int128`, 128, 2); got != expected {
+		t.Errorf(`Expected: "%s" but got %s`, expected, got)
+	}
+
+	expected = "(((unsigned __int128)0xffffffffffffffffULL << 64) | 0xffffffffffffffffULL)"
+	if got := unsignedMaxValue(`__int128`, 128); got != expected {
+		t.Errorf(`Expected: "%s" but got %s`, expected, got)
+	}
+}
+
+func TestRegisterIntTypeMacro(t *testing.T) {
+	env := make(map[string]*macro.Macro)
+	registerIntTypeMacro(env, "int", 32, 2)
+
+	expected := map[string]string{
+		"$INTMIN":  "(-2147483647-1)",
+		"$INTMAX":  "2147483647",
+		"$UINTMIN": "0",
+		"$UINTMAX": "4294967295U",
+	}
+
+	for name, value := range expected {
+		m, ok := env[name]
+		if !ok {
+			t.Errorf("'%s' is not registered", name)
+			continue
+		}
+
+		if m.Name != name || m.Body != value {
+			t.Errorf("Expected %s=%s but got %s=%s", name, value, m.Name, m.Body)
+		}
+	}
+}
+
+func TestSetPredefinedMacros(t *testing.T) {
+	conf := &config.Config{Complement: 2, Lang: "c", HasPrintf: true}
+	conf.Size.Char = 8
+	conf.Size.Short = 16
+	conf.Size.Int = 32
+	conf.Size.Long = 64
+	conf.Size.LongLong = 64
+	conf.Size.Pointer = 32
+	conf.Size.Int128 = 128
+	conf.Size.Float = "ieee754_single"
+	conf.Size.Double = "ieee754_double"
+	conf.Size.LongDouble = "x87_extended"
+
+	generator := &Generator{Config: conf}
+	env, err := generator.setPredefinedMacros()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"$LLONGMIN":    "(-9223372036854775807LL-1)",
+		"$LLONGMAX":    "9223372036854775807LL",
+		"$ULLONGMAX":   "18446744073709551615ULL",
+		"$PTRMAX":      "2147483647",
+		"$UPTRMAX":     "4294967295U",
+		"$FLTMAX":      "3.40282347e+38F",
+		"$DBLMIN":      "2.2250738585072014e-308",
+		"$LDBLEPSILON": "1.08420217248550443401e-19L",
+		"$LONG":        "64",
+		"$POINTER":     "32",
+		"$COMPLEMENT":  "2",
+		"$LANG":        `"c"`,
+		"$HASPRINTF":   "1",
+	}
+
+	for name, value := range expected {
+		m, ok := env[name]
+		if !ok {
+			t.Errorf("'%s' is not registered", name)
+			continue
+		}
+
+		if m.Body != value {
+			t.Errorf("Expected %s=%s but got %s", name, value, m.Body)
+		}
+	}
+
+	for _, name := range []string{"$INT128MIN", "$UINT128MAX", "$PTRMIN", "$FLTMIN", "$LDBLMAX", "$eval", "$if"} {
+		if _, ok := env[name]; !ok {
+			t.Errorf("'%s' is not registered", name)
+		}
+	}
+}
+
+func TestIncludePaths(t *testing.T) {
+	conf := &config.Config{IncludePaths: []string{"conf1", "conf2"}}
+	generator := &Generator{Config: conf, IncludePaths: []string{"cmd"}}
+
+	paths := generator.includePaths()
+	expected := []string{"cmd", "conf1", "conf2"}
+	if len(paths) != len(expected) {
+		t.Fatalf("Expected %v but got %v", expected, paths)
+	}
+
+	for i := range expected {
+		if paths[i] != expected[i] {
+			t.Errorf("Expected %v but got %v", expected, paths)
+			break
+		}
+	}
+}
+
+func TestExpandPatternsUnmatched(t *testing.T) {
+	_, err := expandPatterns([]string{"generator.go", "no-such-dir/*.tt"})
+	patternErr, ok := err.(*PatternError)
+	if !ok {
+		t.Fatalf("Expected PatternError but got %v", err)
+	}
+
+	if patternErr.Pattern != "no-such-dir/*.tt" {
+		t.Errorf("Unmatched pattern is not reported(got=%s)", patternErr.Pattern)
 	}
 }
@@ -0,0 +1,103 @@
+package generator
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/syohex/testgon/template/macro"
+)
+
+// intType is integer type whose limit macros are registered
+type intType struct {
+	name  string
+	width int
+}
+
+// signedName returns spelling of signed type. Plain 'char' may be unsigned,
+// so 'signed char' is used in type lists.
+func (t intType) signedName() string {
+	if t.name == "char" {
+		return "signed char"
+	}
+
+	return t.name
+}
+
+func (t intType) unsignedName() string {
+	return "unsigned " + t.name
+}
+
+// limitMacroNames maps type spellings to names of their limit macros.
+// (ex "unsigned long" => {"$ULONGMIN", "$ULONGMAX"})
+func limitMacroNames(types []intType) map[string][2]string {
+	names := make(map[string][2]string)
+	for _, t := range types {
+		prefix := macroPrefix(t.name)
+		signed := [2]string{
+			"$" + macroTypeName(prefix, SIGNED_TYPE, MIN_VALUE),
+			"$" + macroTypeName(prefix, SIGNED_TYPE, MAX_VALUE),
+		}
+		unsigned := [2]string{
+			"$" + macroTypeName(prefix, UNSIGNED_TYPE, MIN_VALUE),
+			"$" + macroTypeName(prefix, UNSIGNED_TYPE, MAX_VALUE),
+		}
+
+		names[t.name] = signed
+		names[t.signedName()] = signed
+		names[t.unsignedName()] = unsigned
+	}
+
+	return names
+}
+
+func limitOf(env map[string]*macro.Macro, names map[string][2]string, limit int) macro.BuiltinFunc {
+	return func(args []string) (string, error) {
+		typeName := strings.Join(strings.Fields(args[0]), " ")
+		name, ok := names[typeName]
+		if !ok {
+			return "", fmt.Errorf("unknown integer type '%s'", args[0])
+		}
+
+		return env[name[limit]].Body, nil
+	}
+}
+
+// registerTypeListMacros registers lists of integer types which are used
+// by '@matrix' sections, and macros to look up limits of listed types.
+//
+//	$SIGNEDTYPES      signed char, short, int, long, long long
+//	$UNSIGNEDTYPES    unsigned char, unsigned short, ...
+//	$INTTYPES         signed and unsigned types in order of rank
+//	$MINOF(TYPE)      same as $INTMIN if TYPE is 'int'
+//	$MAXOF(TYPE)      same as $ULONGMAX if TYPE is 'unsigned long'
+func registerTypeListMacros(env map[string]*macro.Macro, types []intType) {
+	signed := make([]string, 0, len(types))
+	unsigned := make([]string, 0, len(types))
+	all := make([]string, 0, 2*len(types))
+	for _, t := range types {
+		signed = append(signed, t.signedName())
+		unsigned = append(unsigned, t.unsignedName())
+		all = append(all, t.signedName(), t.unsignedName())
+	}
+
+	lists := map[string][]string{
+		"$SIGNEDTYPES":   signed,
+		"$UNSIGNEDTYPES": unsigned,
+		"$INTTYPES":      all,
+	}
+	for name, list := range lists {
+		env[name] = &macro.Macro{Name: name, Body: strings.Join(list, ", ")}
+	}
+
+	names := limitMacroNames(types)
+	env["$MINOF"] = &macro.Macro{
+		Name:      "$MINOF",
+		DummyArgs: []string{"$type"},
+		Builtin:   limitOf(env, names, MIN_VALUE),
+	}
+	env["$MAXOF"] = &macro.Macro{
+		Name:      "$MAXOF",
+		DummyArgs: []string{"$type"},
+		Builtin:   limitOf(env, names, MAX_VALUE),
+	}
+}
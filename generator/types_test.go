@@ -0,0 +1,48 @@
+package generator
+
+import (
+	"testing"
+
+	"github.com/syohex/testgon/template/macro"
+)
+
+func TestRegisterTypeListMacros(t *testing.T) {
+	env := make(map[string]*macro.Macro)
+	types := []intType{{"char", 8}, {"int", 32}, {"long long", 64}}
+	for _, t := range types {
+		registerIntTypeMacro(env, t.name, t.width, 2)
+	}
+	registerTypeListMacros(env, types)
+
+	tests := []struct {
+		body     string
+		expected string
+	}{
+		{"$SIGNEDTYPES", "signed char, int, long long"},
+		{"$UNSIGNEDTYPES", "unsigned char, unsigned int, unsigned long long"},
+		{"$INTTYPES", "signed char, unsigned char, int, unsigned int, long long, unsigned long long"},
+		{"$MAXOF(int)", "2147483647"},
+		{"$MINOF(signed char)", "(-127-1)"},
+		{"$MAXOF(char)", "127"},
+		{"$MAXOF(unsigned  long long)", "18446744073709551615ULL"},
+		{"$MINOF(unsigned int)", "0"},
+	}
+
+	for _, test := range tests {
+		m := &macro.Macro{Name: "test", Body: test.body}
+		got, err := m.Evaluate(nil, env)
+		if err != nil {
+			t.Errorf("%s: %s", test.body, err)
+			continue
+		}
+
+		if got != test.expected {
+			t.Errorf("%s: Expected '%s' but got '%s'", test.body, test.expected, got)
+		}
+	}
+
+	m := &macro.Macro{Name: "test", Body: "$MAXOF(long)"}
+	if _, err := m.Evaluate(nil, env); err == nil {
+		t.Error("type which is not registered but error is not returned")
+	}
+}
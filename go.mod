@@ -0,0 +1,5 @@
+module github.com/syohex/testgon
+
+go 1.20
+
+require golang.org/x/text v0.14.0
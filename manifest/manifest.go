@@ -0,0 +1,85 @@
+package manifest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// FileName is name of manifest file written in each test directory
+const FileName = "testgon-manifest.json"
+
+// Entry describes expectation of one generated file
+type Entry struct {
+	File string `json:"file"`
+	Ok   int    `json:"ok"`
+}
+
+// Manifest holds expectations of generated files in one directory
+type Manifest struct {
+	Entries []*Entry `json:"entries"`
+
+	// index maps file name to entry. It is built from Entries on demand.
+	index map[string]*Entry
+}
+
+func New() *Manifest {
+	return &Manifest{Entries: make([]*Entry, 0)}
+}
+
+func (manifest *Manifest) entryIndex() map[string]*Entry {
+	if manifest.index == nil {
+		manifest.index = make(map[string]*Entry, len(manifest.Entries))
+		for _, entry := range manifest.Entries {
+			manifest.index[entry.File] = entry
+		}
+	}
+
+	return manifest.index
+}
+
+// Add records expected count of OK markers of file. Entry is overwritten
+// if file is already recorded.
+func (manifest *Manifest) Add(file string, ok int) {
+	if entry, found := manifest.Lookup(file); found {
+		entry.Ok = ok
+		return
+	}
+
+	entry := &Entry{File: file, Ok: ok}
+	manifest.Entries = append(manifest.Entries, entry)
+	manifest.entryIndex()[file] = entry
+}
+
+func (manifest *Manifest) Lookup(file string) (*Entry, bool) {
+	entry, ok := manifest.entryIndex()[file]
+	return entry, ok
+}
+
+// Read loads manifest in dir. Empty manifest is returned if dir does
+// not have manifest file.
+func Read(dir string) (*Manifest, error) {
+	bytes, err := ioutil.ReadFile(filepath.Join(dir, FileName))
+	if os.IsNotExist(err) {
+		return New(), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	manifest := New()
+	if err := json.Unmarshal(bytes, manifest); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+func (manifest *Manifest) Write(dir string) error {
+	bytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, FileName), append(bytes, '\n'), 0644)
+}
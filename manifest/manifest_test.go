@@ -0,0 +1,60 @@
+package manifest
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestAdd(t *testing.T) {
+	manifest := New()
+	manifest.Add("fn001.c", 3)
+	manifest.Add("fn002.c", 1)
+	manifest.Add("fn001.c", 2)
+
+	if len(manifest.Entries) != 2 {
+		t.Fatalf("Expected 2 entries but got %d", len(manifest.Entries))
+	}
+
+	entry, ok := manifest.Lookup("fn001.c")
+	if !ok || entry.Ok != 2 {
+		t.Error("entry is not overwritten")
+	}
+
+	if _, ok := manifest.Lookup("fn003.c"); ok {
+		t.Error("not recorded file is found")
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testgon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	empty, err := Read(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(empty.Entries) != 0 {
+		t.Error("manifest should be empty if manifest file does not exist")
+	}
+
+	manifest := New()
+	manifest.Add("fn001.c", 3)
+	if err := manifest.Write(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := Read(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, ok := read.Lookup("fn001.c")
+	if !ok || entry.Ok != 3 {
+		t.Error("failed to read written manifest")
+	}
+}
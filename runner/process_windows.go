@@ -0,0 +1,12 @@
+//go:build windows
+
+package runner
+
+import (
+	"os/exec"
+	"time"
+)
+
+func setupCommand(cmd *exec.Cmd) {
+	cmd.WaitDelay = time.Second
+}
@@ -0,0 +1,70 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Summary counts results for each status
+func Summary(results []*Result) map[Status]int {
+	counts := make(map[Status]int)
+	for _, result := range results {
+		counts[result.Status]++
+	}
+
+	return counts
+}
+
+// Failed returns true if any result is not passed
+func Failed(results []*Result) bool {
+	for _, result := range results {
+		if result.Status != PASS {
+			return true
+		}
+	}
+
+	return false
+}
+
+func reportCountDiff(w io.Writer, result *Result) {
+	expected := "at least 1"
+	if result.Expected != unknownExpectation {
+		expected = fmt.Sprintf("%d", result.Expected)
+	}
+
+	fmt.Fprintln(w, "    --- expected")
+	fmt.Fprintln(w, "    +++ actual")
+	fmt.Fprintf(w, "    -%s x %s\n", result.Marker, expected)
+	fmt.Fprintf(w, "    +%s x %d\n", result.Marker, result.Actual)
+}
+
+// Report writes results and their summary
+func Report(w io.Writer, results []*Result) {
+	for _, result := range results {
+		fmt.Fprintf(w, "%-13s %s", result.Status, result.Source)
+		if result.Option != "" {
+			fmt.Fprintf(w, " [%s]", result.Option)
+		}
+		fmt.Fprintln(w)
+
+		if result.Status == WRONG_OUTPUT {
+			reportCountDiff(w, result)
+		}
+
+		if result.Status != PASS && result.Output != "" {
+			for _, line := range strings.Split(strings.TrimRight(result.Output, "\n"), "\n") {
+				fmt.Fprintf(w, "    %s\n", line)
+			}
+		}
+	}
+
+	counts := Summary(results)
+	summaries := make([]string, 0)
+	for status := range statusNames {
+		if count := counts[Status(status)]; count > 0 {
+			summaries = append(summaries, fmt.Sprintf("%s: %d", Status(status), count))
+		}
+	}
+	fmt.Fprintf(w, "\n%d tests (%s)\n", len(results), strings.Join(summaries, ", "))
+}
@@ -0,0 +1,363 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/syohex/testgon/config"
+	"github.com/syohex/testgon/manifest"
+)
+
+// Status is result of one test case
+type Status int
+
+const (
+	PASS Status = iota
+	COMPILE_ERROR
+	LINK_ERROR
+	RUNTIME_CRASH
+	TIMEOUT
+	WRONG_OUTPUT
+)
+
+var statusNames = []string{
+	PASS:          "PASS",
+	COMPILE_ERROR: "COMPILE ERROR",
+	LINK_ERROR:    "LINK ERROR",
+	RUNTIME_CRASH: "RUNTIME CRASH",
+	TIMEOUT:       "TIMEOUT",
+	WRONG_OUTPUT:  "WRONG OUTPUT",
+}
+
+func (status Status) String() string {
+	if int(status) < len(statusNames) {
+		return statusNames[status]
+	}
+
+	return fmt.Sprintf("Status(%d)", int(status))
+}
+
+// Result describes how one generated source is handled with one option
+type Result struct {
+	Source string
+	Option string
+	Status Status
+	Output string
+
+	// Expected and Actual are count of Marker in program output.
+	// Expected is -1 if the source is not recorded in manifest.
+	Marker   string
+	Expected int
+	Actual   int
+}
+
+type Runner struct {
+	Config *config.Config
+}
+
+func New(conf *config.Config) *Runner {
+	return &Runner{Config: conf}
+}
+
+var sourceSuffixes = map[string][]string{
+	"c":   {".c"},
+	"c++": {".cpp", ".cc", ".cxx"},
+}
+
+func (runner *Runner) isSourceFile(path string) bool {
+	suffixes, ok := sourceSuffixes[runner.Config.Lang]
+	if !ok {
+		suffixes = sourceSuffixes["c"]
+	}
+
+	ext := filepath.Ext(path)
+	for _, suffix := range suffixes {
+		if ext == suffix {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (runner *Runner) collectSources() ([]string, error) {
+	sources := make([]string, 0)
+
+	err := filepath.Walk(runner.Config.TestDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() && runner.isSourceFile(path) {
+			sources = append(sources, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(sources)
+	return sources, nil
+}
+
+func (runner *Runner) options() []string {
+	if len(runner.Config.Options) == 0 {
+		return []string{""}
+	}
+
+	return runner.Config.Options
+}
+
+func (runner *Runner) splitOption(option string) []string {
+	args := make([]string, 0)
+	for _, arg := range strings.Split(option, runner.Config.OptionSeparator) {
+		arg = strings.TrimSpace(arg)
+		if arg != "" {
+			args = append(args, arg)
+		}
+	}
+
+	return args
+}
+
+type job struct {
+	source   string
+	index    int
+	option   string
+	expected int
+}
+
+// unknownExpectation means source is not recorded in manifest. Such test
+// passes if its output has at least one expected marker.
+const unknownExpectation = -1
+
+func (runner *Runner) collectJobs() ([]*job, error) {
+	sources, err := runner.collectSources()
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := make(map[string]*manifest.Manifest)
+	jobs := make([]*job, 0)
+	for _, source := range sources {
+		dir := filepath.Dir(source)
+		files, ok := manifests[dir]
+		if !ok {
+			if files, err = manifest.Read(dir); err != nil {
+				return nil, err
+			}
+			manifests[dir] = files
+		}
+
+		expected := unknownExpectation
+		if entry, ok := files.Lookup(filepath.Base(source)); ok {
+			expected = entry.Ok
+		}
+
+		for index, option := range runner.options() {
+			jobs = append(jobs, &job{
+				source:   source,
+				index:    index,
+				option:   option,
+				expected: expected,
+			})
+		}
+	}
+
+	return jobs, nil
+}
+
+// Run compiles, links and executes all sources under test directory
+func (runner *Runner) Run() ([]*Result, error) {
+	return runner.RunContext(context.Background())
+}
+
+// RunContext is same as Run but it stops running tests and kills child
+// processes when ctx is done. Up to 'parallels' tests run concurrently and
+// results are ordered by source file name and option regardless of it.
+func (runner *Runner) RunContext(ctx context.Context) ([]*Result, error) {
+	jobs, err := runner.collectJobs()
+	if err != nil {
+		return nil, err
+	}
+
+	parallels := runner.Config.Parallels
+	if parallels < 1 {
+		parallels = 1
+	}
+
+	results := make([]*Result, len(jobs))
+	queue := make(chan int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < parallels; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				j := jobs[i]
+				results[i] = runner.runTest(ctx, j)
+			}
+		}()
+	}
+
+dispatch:
+	for i := range jobs {
+		select {
+		case queue <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return finishedResults(results), err
+	}
+
+	return results, nil
+}
+
+func finishedResults(results []*Result) []*Result {
+	finished := make([]*Result, 0)
+	for _, result := range results {
+		if result != nil {
+			finished = append(finished, result)
+		}
+	}
+
+	return finished
+}
+
+func artifactName(source string, index int, suffix string) string {
+	base := strings.TrimSuffix(source, filepath.Ext(source))
+	return base + "." + strconv.Itoa(index) + suffix
+}
+
+func (runner *Runner) runTest(ctx context.Context, j *job) *Result {
+	conf := runner.Config
+	result := &Result{
+		Source:   j.source,
+		Option:   j.option,
+		Marker:   conf.Expect,
+		Expected: j.expected,
+	}
+	optionArgs := runner.splitOption(j.option)
+
+	source := j.source
+	object := artifactName(source, j.index, ".o")
+	args := make([]string, 0)
+	args = append(args, conf.CFlags...)
+	args = append(args, optionArgs...)
+	args = append(args, "-c", source, conf.OutputOption, object)
+	if output, err := runner.execute(ctx, conf.Compiler, args...); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		result.Status = COMPILE_ERROR
+		result.Output = output
+		return result
+	}
+
+	if conf.CompileOnly {
+		result.Status = PASS
+		return result
+	}
+
+	executable := artifactName(source, j.index, ".exe")
+	args = make([]string, 0)
+	args = append(args, optionArgs...)
+	args = append(args, object)
+	args = append(args, conf.LDFlags...)
+	args = append(args, conf.OutputOption, executable)
+	if output, err := runner.execute(ctx, conf.Compiler, args...); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		result.Status = LINK_ERROR
+		result.Output = output
+		return result
+	}
+
+	runner.runExecutable(ctx, executable, result)
+	if ctx.Err() != nil {
+		// killed by cancellation, so the result is not meaningful
+		return nil
+	}
+	return result
+}
+
+func (runner *Runner) execute(ctx context.Context, command string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, command, args...)
+	setupCommand(cmd)
+
+	output, err := cmd.CombinedOutput()
+	return string(output), err
+}
+
+func (runner *Runner) runExecutable(parent context.Context, executable string, result *Result) {
+	conf := runner.Config
+
+	path, err := filepath.Abs(executable)
+	if err != nil {
+		result.Status = RUNTIME_CRASH
+		result.Output = err.Error()
+		return
+	}
+
+	timeout := time.Duration(conf.Timeout) * time.Second
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if conf.Simulator != "" {
+		cmd = exec.CommandContext(ctx, conf.Simulator, path)
+	} else {
+		cmd = exec.CommandContext(ctx, path)
+	}
+	cmd.Dir = filepath.Dir(path)
+	setupCommand(cmd)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	result.Output = stdout.String() + stderr.String()
+	if ctx.Err() == context.DeadlineExceeded {
+		result.Status = TIMEOUT
+		return
+	}
+
+	if err != nil {
+		result.Status = RUNTIME_CRASH
+		result.Output += err.Error() + "\n"
+		return
+	}
+
+	result.Status = PASS
+	if !conf.HasPrintf {
+		return
+	}
+
+	result.Actual = strings.Count(stdout.String(), conf.Expect)
+	if result.Expected == unknownExpectation {
+		if result.Actual == 0 {
+			result.Status = WRONG_OUTPUT
+		}
+	} else if result.Actual != result.Expected {
+		result.Status = WRONG_OUTPUT
+	}
+}
@@ -0,0 +1,267 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/syohex/testgon/config"
+	"github.com/syohex/testgon/manifest"
+)
+
+func testConfig(t *testing.T, dir string) *config.Config {
+	if _, err := exec.LookPath("cc"); err != nil {
+		t.Skip("'cc' is not found in PATH")
+	}
+
+	return &config.Config{
+		Compiler:        "cc",
+		TestDir:         dir,
+		Timeout:         1,
+		Lang:            "c",
+		Expect:          "@OK@",
+		OutputOption:    "-o",
+		OptionSeparator: " ",
+		HasPrintf:       true,
+	}
+}
+
+func writeSource(t *testing.T, dir string, name string, content string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func runSource(t *testing.T, content string) *Result {
+	dir, err := ioutil.TempDir("", "testgon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeSource(t, dir, "test.c", content)
+
+	results, err := New(testConfig(t, dir)).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 result but got %d", len(results))
+	}
+
+	return results[0]
+}
+
+func TestRunPass(t *testing.T) {
+	result := runSource(t, `#include <stdio.h>
+int main(void) { printf("@OK@\n"); return 0; }
+`)
+	if result.Status != PASS {
+		t.Errorf("Expected PASS but got %s(%s)", result.Status, result.Output)
+	}
+}
+
+func TestRunCompileError(t *testing.T) {
+	result := runSource(t, `int main(void) { return }`)
+	if result.Status != COMPILE_ERROR {
+		t.Errorf("Expected COMPILE ERROR but got %s", result.Status)
+	}
+}
+
+func TestRunLinkError(t *testing.T) {
+	result := runSource(t, `extern int undefined_function(void);
+int main(void) { return undefined_function(); }
+`)
+	if result.Status != LINK_ERROR {
+		t.Errorf("Expected LINK ERROR but got %s", result.Status)
+	}
+}
+
+func TestRunRuntimeCrash(t *testing.T) {
+	result := runSource(t, `#include <stdlib.h>
+int main(void) { abort(); return 0; }
+`)
+	if result.Status != RUNTIME_CRASH {
+		t.Errorf("Expected RUNTIME CRASH but got %s", result.Status)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	result := runSource(t, `int main(void) { for (;;) {} return 0; }`)
+	if result.Status != TIMEOUT {
+		t.Errorf("Expected TIMEOUT but got %s", result.Status)
+	}
+}
+
+func TestRunWrongOutput(t *testing.T) {
+	result := runSource(t, `#include <stdio.h>
+int main(void) { printf("@NG@\n"); return 0; }
+`)
+	if result.Status != WRONG_OUTPUT {
+		t.Errorf("Expected WRONG OUTPUT but got %s", result.Status)
+	}
+}
+
+func TestRunOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testgon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeSource(t, dir, "b.c", `int main(void) { return 0; }`)
+	writeSource(t, dir, "a.c", `int main(void) { return 0; }`)
+	writeSource(t, dir, "README", `not source`)
+
+	conf := testConfig(t, dir)
+	conf.Options = []string{"-O0", "-O2 -g"}
+	conf.CompileOnly = true
+
+	results, err := New(conf).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 4 {
+		t.Fatalf("Expected 4 results but got %d", len(results))
+	}
+
+	if !strings.HasSuffix(results[0].Source, "a.c") || results[1].Option != "-O2 -g" {
+		t.Errorf("results are not sorted(got=%s %s)", results[0].Source, results[1].Option)
+	}
+
+	if Failed(results) {
+		t.Error("compile only tests should pass")
+	}
+}
+
+func TestSplitOption(t *testing.T) {
+	runner := New(&config.Config{OptionSeparator: "--"})
+	args := runner.splitOption("-O2 --  -g")
+	if len(args) != 2 || args[0] != "-O2" || args[1] != "-g" {
+		t.Errorf("failed to split option(got=%v)", args)
+	}
+}
+
+func TestRunParallel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testgon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 8; i++ {
+		writeSource(t, dir, fmt.Sprintf("test%d.c", i), `#include <stdio.h>
+int main(void) { printf("@OK@\n"); return 0; }
+`)
+	}
+
+	conf := testConfig(t, dir)
+	conf.Parallels = 4
+
+	results, err := New(conf).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 8 {
+		t.Fatalf("Expected 8 results but got %d", len(results))
+	}
+
+	for i, result := range results {
+		expected := filepath.Join(dir, fmt.Sprintf("test%d.c", i))
+		if result.Source != expected {
+			t.Errorf("Expected %s at %d but got %s", expected, i, result.Source)
+		}
+
+		if result.Status != PASS {
+			t.Errorf("Expected PASS but got %s(%s)", result.Status, result.Output)
+		}
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testgon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 4; i++ {
+		writeSource(t, dir, fmt.Sprintf("loop%d.c", i), `int main(void) { for (;;) {} return 0; }`)
+	}
+
+	conf := testConfig(t, dir)
+	conf.Timeout = 30
+	conf.Parallels = 2
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	results, err := New(conf).RunContext(ctx)
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled but got %v", err)
+	}
+
+	for _, result := range results {
+		t.Errorf("Interrupted job must not be reported: %s %s", result.Source, result.Status)
+	}
+
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("running tests are not stopped(elapsed=%s)", elapsed)
+	}
+}
+
+func TestRunOkCount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testgon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := `#include <stdio.h>
+int main(void) { printf("@OK@\n@OK@\n"); return 0; }
+`
+	writeSource(t, dir, "two.c", source)
+	writeSource(t, dir, "three.c", source)
+
+	files := manifest.New()
+	files.Add("two.c", 2)
+	files.Add("three.c", 3)
+	if err := files.Write(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := New(testConfig(t, dir)).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	three, two := results[0], results[1]
+	if two.Status != PASS {
+		t.Errorf("Expected PASS but got %s", two.Status)
+	}
+
+	if three.Status != WRONG_OUTPUT || three.Expected != 3 || three.Actual != 2 {
+		t.Errorf("Expected WRONG OUTPUT(3 vs 2) but got %s(%d vs %d)",
+			three.Status, three.Expected, three.Actual)
+	}
+
+	var report bytes.Buffer
+	Report(&report, results)
+	if !strings.Contains(report.String(), "-@OK@ x 3\n    +@OK@ x 2\n") {
+		t.Errorf("count difference is not reported(got=%s)", report.String())
+	}
+}
@@ -0,0 +1,191 @@
+package template
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+var startSection = regexp.MustCompile(`^@([^_\s:]+)`)
+var endSection = regexp.MustCompile(`^@([^_\s]+)_`)
+
+// Section is a section in template. Line and EndLine are line numbers of
+// start and end of section, and they are same if section is one line
+// section. (ex @file a.c $main() @file_) Arg is text after section name
+// in start line, and Content is lines between start and end. ElseLine is
+// line number of '@else' in '@if' section, or 0 if it has no '@else'.
+type Section struct {
+	Name     string
+	Arg      string
+	Content  string
+	Line     int
+	EndLine  int
+	ElseLine int
+	Children []*Section
+}
+
+// body returns argument and content of section as one text
+func (section *Section) body() string {
+	if section.EndLine == section.Line {
+		return section.Arg
+	}
+
+	return section.Arg + "\n" + section.Content
+}
+
+// position returns line and column of offset in body of section
+func (section *Section) position(offset int) (int, int) {
+	body := section.body()
+	line := section.Line + strings.Count(body[:offset], "\n")
+	if start := strings.LastIndex(body[:offset], "\n"); start >= 0 {
+		return line, offset - start
+	}
+
+	// Arg follows '@' and section name
+	return line, len(section.Name) + offset + 2
+}
+
+// Document is template loaded in memory. Lines are raw text of template
+// and Sections are its top level sections. Validation and generation use
+// the same Document, so template is read only once.
+type Document struct {
+	File      string
+	FirstLine int
+	Lines     []string
+	Sections  []*Section
+}
+
+// Line returns text of line n. It returns empty string if n is out of the
+// document.
+func (doc *Document) Line(n int) string {
+	index := n - doc.FirstLine
+	if index < 0 || index >= len(doc.Lines) {
+		return ""
+	}
+
+	return strings.TrimRight(doc.Lines[index], "\r")
+}
+
+// oneLineSection reports whether section starts and ends in line.
+// (ex @file a.c $main() @file_)
+func oneLineSection(name string, line string) bool {
+	return strings.HasSuffix(strings.TrimRight(line, " \t\r"), "@"+name+"_")
+}
+
+// ReadDocument reads template from r. file is used for error messages.
+// *SyntaxError is returned if sections in it are not balanced.
+func ReadDocument(file string, r io.Reader) (*Document, error) {
+	return readDocument(file, r, 1)
+}
+
+// readDocument reads template whose first line is firstLine of file
+func readDocument(file string, r io.Reader, firstLine int) (*Document, error) {
+	doc := &Document{File: file, FirstLine: firstLine, Lines: make([]string, 0)}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		doc.Lines = append(doc.Lines, scanner.Text())
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := doc.buildSections(); err != nil {
+		if syntaxErr, ok := err.(*SyntaxError); ok {
+			syntaxErr.Source = doc.Line(syntaxErr.Line)
+		}
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+func (doc *Document) buildSections() error {
+	stack := make([]*Section, 0)
+	add := func(section *Section) {
+		if len(stack) == 0 {
+			doc.Sections = append(doc.Sections, section)
+		} else {
+			parent := stack[len(stack)-1]
+			parent.Children = append(parent.Children, section)
+		}
+	}
+
+	for i, line := range doc.Lines {
+		currentLine := doc.FirstLine + i
+
+		if matched := endSection.FindStringSubmatch(line); matched != nil {
+			name := matched[1]
+
+			if len(stack) == 0 {
+				return newSyntaxError(currentLine, "found only '%s' end at %d",
+					name, currentLine)
+			}
+
+			last := stack[len(stack)-1]
+			if name != last.Name {
+				return newSyntaxError(last.Line, "missing end of '%s' section(at %d)",
+					last.Name, last.Line)
+			}
+
+			last.EndLine = currentLine
+			last.Content = strings.Join(doc.Lines[last.Line-doc.FirstLine+1:i], "\n")
+			stack = stack[:len(stack)-1]
+			add(last)
+		} else if matched := startSection.FindStringSubmatch(line); matched != nil {
+			name := matched[1]
+			arg := line[len(matched[0]):]
+
+			// '@else' divides '@if' section and it doesn't have end of section
+			if name == "else" {
+				if len(stack) == 0 || stack[len(stack)-1].Name != "if" {
+					return newSyntaxError(currentLine, "'@else' is not in 'if' section(at %d)",
+						currentLine)
+				}
+
+				last := stack[len(stack)-1]
+				if last.ElseLine != 0 {
+					return newSyntaxError(currentLine, "duplicated '@else' in 'if' section(at %d)",
+						currentLine)
+				}
+
+				last.ElseLine = currentLine
+				continue
+			}
+
+			if name == "if" && strings.TrimSpace(arg) == "" {
+				return newSyntaxError(currentLine, "'@if' doesn't have condition(at %d)",
+					currentLine)
+			}
+
+			section := &Section{Name: name, Arg: arg, Line: currentLine}
+			if oneLineSection(name, line) {
+				section.Arg = strings.TrimSuffix(strings.TrimRight(arg, " \t\r"), "@"+name+"_")
+				section.EndLine = currentLine
+				add(section)
+			} else {
+				stack = append(stack, section)
+			}
+		}
+	}
+
+	if len(stack) != 0 {
+		messages := make([]string, 0)
+
+		for _, section := range stack {
+			msg := fmt.Sprintf("'%s' section doesn't have end of section(at %d)",
+				section.Name, section.Line)
+			messages = append(messages, msg)
+		}
+
+		return &SyntaxError{
+			Line:    stack[0].Line,
+			Message: strings.Join(messages, "\n"),
+		}
+	}
+
+	return nil
+}
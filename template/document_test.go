@@ -0,0 +1,100 @@
+package template
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadDocument(t *testing.T) {
+	input := `text
+@def $x
+@comment
+ignored
+@comment_
+1
+@def_
+@dir test int
+@file a.c $main(0) @file_
+@dir_
+`
+	doc, err := ReadDocument("test.tt", strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(doc.Lines) != 10 || doc.Line(1) != "text" || doc.Line(11) != "" {
+		t.Errorf("lines are not loaded(got=%q)", doc.Lines)
+	}
+
+	if len(doc.Sections) != 2 {
+		t.Fatalf("Expected 2 top level sections but got %d", len(doc.Sections))
+	}
+
+	def := doc.Sections[0]
+	if def.Name != "def" || def.Arg != " $x" || def.Line != 2 || def.EndLine != 7 {
+		t.Errorf("unexpected section %#v", def)
+	}
+
+	if def.Content != "@comment\nignored\n@comment_\n1" {
+		t.Errorf("unexpected content %q", def.Content)
+	}
+
+	if len(def.Children) != 1 || def.Children[0].Name != "comment" {
+		t.Errorf("nested section is not loaded(got=%v)", def.Children)
+	}
+
+	dir := doc.Sections[1]
+	if len(dir.Children) != 1 {
+		t.Fatalf("one line section is not loaded(got=%v)", dir.Children)
+	}
+
+	file := dir.Children[0]
+	if file.Arg != " a.c $main(0) " || file.Line != 9 || file.EndLine != 9 || file.Content != "" {
+		t.Errorf("unexpected one line section %#v", file)
+	}
+
+	if line, column := file.position(strings.Index(file.Arg, "$main")); line != 9 || column != 11 {
+		t.Errorf("Expected position 9:11 but got %d:%d", line, column)
+	}
+}
+
+func TestReadDocumentElse(t *testing.T) {
+	input := `@if 1
+@file a.c
+  $main(0)
+@file_
+@else
+@file b.c $main(1) @file_
+@if_
+`
+	doc, err := ReadDocument("test.tt", strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	section := doc.Sections[0]
+	if section.ElseLine != 5 || len(section.Children) != 2 {
+		t.Fatalf("unexpected '@if' section %#v", section)
+	}
+
+	file := section.Children[0]
+	if file.body() != " a.c\n  $main(0)" {
+		t.Errorf("unexpected body %q", file.body())
+	}
+
+	if line, column := file.position(strings.Index(file.body(), "$main")); line != 3 || column != 3 {
+		t.Errorf("Expected position 3:3 but got %d:%d", line, column)
+	}
+}
+
+func TestReadDocumentSyntaxError(t *testing.T) {
+	_, err := ReadDocument("test.tt", strings.NewReader("@def $x\n@dir\n@def_\n"))
+	syntaxErr, ok := err.(*SyntaxError)
+	if !ok {
+		t.Fatalf("Expected syntax error but got %v", err)
+	}
+
+	if syntaxErr.Line != 2 {
+		t.Errorf("Expected error at line 2 but got %d", syntaxErr.Line)
+	}
+}
@@ -0,0 +1,118 @@
+package template
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+)
+
+// DefaultEncoding is encoding of templates and generated files if it is
+// not specified
+const DefaultEncoding = "utf-8"
+
+// encodings maps names of encoding to their implementations. UTF-8 is nil
+// because text is not converted.
+var encodings = map[string]encoding.Encoding{
+	"utf-8":      nil,
+	"utf8":       nil,
+	"shift_jis":  japanese.ShiftJIS,
+	"sjis":       japanese.ShiftJIS,
+	"euc-jp":     japanese.EUCJP,
+	"eucjp":      japanese.EUCJP,
+	"iso-8859-1": charmap.ISO8859_1,
+	"latin-1":    charmap.ISO8859_1,
+	"latin1":     charmap.ISO8859_1,
+}
+
+func lookupEncoding(name string) (encoding.Encoding, error) {
+	if name == "" {
+		name = DefaultEncoding
+	}
+
+	enc, ok := encodings[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("Unknown encoding '%s'", name)
+	}
+
+	return enc, nil
+}
+
+// CheckEncoding returns error if encoding is not supported
+func CheckEncoding(name string) error {
+	_, err := lookupEncoding(name)
+	return err
+}
+
+// lineOf returns line number of offset in text
+func lineOf(text []byte, offset int) int {
+	return bytes.Count(text[:offset], []byte("\n")) + 1
+}
+
+// decodeText converts text in encoding name to UTF-8
+func decodeText(text []byte, name string) (string, error) {
+	enc, err := lookupEncoding(name)
+	if err != nil {
+		return "", err
+	}
+
+	if enc == nil {
+		if !utf8.Valid(text) {
+			offset := 0
+			for utf8.FullRune(text[offset:]) {
+				r, size := utf8.DecodeRune(text[offset:])
+				if r == utf8.RuneError && size <= 1 {
+					break
+				}
+				offset += size
+			}
+			return "", fmt.Errorf("invalid %s byte sequence at line %d", name, lineOf(text, offset))
+		}
+		return string(text), nil
+	}
+
+	decoded, err := enc.NewDecoder().Bytes(text)
+	if err != nil {
+		return "", fmt.Errorf("can't decode as %s: %s", name, err)
+	}
+
+	// decoders replace invalid byte sequences with U+FFFD which is not in
+	// supported legacy encodings
+	if index := bytes.IndexRune(decoded, utf8.RuneError); index >= 0 {
+		return "", fmt.Errorf("invalid %s byte sequence at line %d", name, lineOf(decoded, index))
+	}
+
+	return string(decoded), nil
+}
+
+// encodeText converts UTF-8 text to encoding name. Error has the first
+// character which can't be represented in the encoding.
+func encodeText(text string, name string) ([]byte, error) {
+	enc, err := lookupEncoding(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if enc == nil {
+		return []byte(text), nil
+	}
+
+	encoded, err := enc.NewEncoder().Bytes([]byte(text))
+	if err == nil {
+		return encoded, nil
+	}
+
+	encoder := enc.NewEncoder()
+	for offset, r := range text {
+		if _, err := encoder.String(string(r)); err != nil {
+			return nil, fmt.Errorf("'%c'(U+%04X) at line %d can't be represented in %s",
+				r, r, lineOf([]byte(text), offset), name)
+		}
+	}
+
+	return nil, fmt.Errorf("can't encode as %s: %s", name, err)
+}
@@ -0,0 +1,101 @@
+package template
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncodingRoundTrip(t *testing.T) {
+	tests := []struct {
+		encoding string
+		text     string
+	}{
+		{"utf-8", "/* テスト */ int main(void) { return 0; }\n"},
+		{"shift_jis", "/* テスト */ puts(\"表示\");\n"},
+		{"EUC-JP", "/* テスト */ puts(\"表示\");\n"},
+		{"latin-1", "/* café */ puts(\"Ünïcödé\");\n"},
+	}
+
+	for _, test := range tests {
+		encoded, err := encodeText(test.text, test.encoding)
+		if err != nil {
+			t.Errorf("%s: %s", test.encoding, err)
+			continue
+		}
+
+		if test.encoding != "utf-8" && string(encoded) == test.text {
+			t.Errorf("%s: text is not converted", test.encoding)
+		}
+
+		decoded, err := decodeText(encoded, test.encoding)
+		if err != nil {
+			t.Errorf("%s: %s", test.encoding, err)
+			continue
+		}
+
+		if decoded != test.text {
+			t.Errorf("%s: Expected '%s' but got '%s'", test.encoding, test.text, decoded)
+		}
+	}
+}
+
+func TestEncodeUnrepresentable(t *testing.T) {
+	_, err := encodeText("int x;\n/* 日本 */\n", "latin-1")
+	if err == nil {
+		t.Fatal("unrepresentable character but error is not returned")
+	}
+
+	expected := "'日'(U+65E5) at line 2 can't be represented in latin-1"
+	if err.Error() != expected {
+		t.Errorf("Expected '%s' but got '%s'", expected, err.Error())
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	if _, err := decodeText([]byte("ok\n\xff\xfe\n"), "utf-8"); err == nil ||
+		!strings.Contains(err.Error(), "line 2") {
+		t.Errorf("invalid UTF-8 is not reported with line(got=%v)", err)
+	}
+
+	if _, err := decodeText([]byte("\x81\n"), "shift_jis"); err == nil {
+		t.Error("invalid Shift_JIS but error is not returned")
+	}
+
+	if err := CheckEncoding("ebcdic"); err == nil {
+		t.Error("unknown encoding but error is not returned")
+	}
+}
+
+func TestParseEncoding(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	template, err := encodeText("@dir test\n@file a.c $main(\"表示\") @file_\n@dir_\n", "shift_jis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTemplates(t, dir, map[string]string{"test.tt": string(template)})
+
+	parser.TemplateEncoding = "shift_jis"
+	parser.OutputEncoding = "euc-jp"
+	if err := parser.Parse(filepath.Join(dir, "test.tt")); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := readGeneratedFile(t, filepath.Join(dir, "test", "a.c"))
+	got, err := decodeText([]byte(raw), "euc-jp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != "int main(void) { return \"表示\"; }\n" {
+		t.Errorf("unexpected generated file '%s'", got)
+	}
+
+	parser.OutputEncoding = "latin-1"
+	if err := parser.Parse(filepath.Join(dir, "test.tt")); err == nil {
+		t.Error("unrepresentable character in output but error is not returned")
+	}
+}
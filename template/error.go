@@ -0,0 +1,121 @@
+package template
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/syohex/testgon/template/macro"
+)
+
+// Position is position of line in template file
+type Position struct {
+	File string
+	Line int
+}
+
+// Error is error in template with its position. Line and Column start
+// from 1 and they are 0 if unknown. Includes is positions of '@include'
+// sections through which File is included, outermost first. Source is the
+// line of template where error occurs.
+type Error struct {
+	File     string
+	Line     int
+	Column   int
+	Includes []Position
+	Source   string
+	Message  string
+
+	// Err is original error. (ex *SyntaxError, *macro.ExpansionError)
+	Err error
+}
+
+// Position returns position of err like 'file.tt:12:5'
+func (err *Error) Position() string {
+	switch {
+	case err.Line == 0:
+		return err.File
+	case err.Column == 0:
+		return fmt.Sprintf("%s:%d", err.File, err.Line)
+	default:
+		return fmt.Sprintf("%s:%d:%d", err.File, err.Line, err.Column)
+	}
+}
+
+func (err *Error) Error() string {
+	if err.File == "" {
+		return err.Message
+	}
+
+	return err.Position() + ": " + err.Message
+}
+
+func (err *Error) Unwrap() error {
+	return err.Err
+}
+
+// Excerpt returns Source and a caret under Column like compilers. It
+// returns empty string if Source is unknown.
+func (err *Error) Excerpt() string {
+	if err.Source == "" {
+		return ""
+	}
+
+	excerpt := err.Source + "\n"
+	if err.Column == 0 || err.Column > len(err.Source)+1 {
+		return excerpt
+	}
+
+	// keep tabs so that caret is put under the same column
+	var caret strings.Builder
+	for _, c := range err.Source[:err.Column-1] {
+		if c == '\t' {
+			caret.WriteByte('\t')
+		} else {
+			caret.WriteByte(' ')
+		}
+	}
+
+	return excerpt + caret.String() + "^\n"
+}
+
+// errorMessage returns message of err without its position
+func errorMessage(err error) string {
+	if e, ok := err.(*macro.ExpansionError); ok && e.File != "" {
+		copied := *e
+		copied.File = ""
+		return copied.Error()
+	}
+
+	return err.Error()
+}
+
+// sourceLine returns text of line in current file. It returns empty string
+// if current file is not loaded.
+func (parser *Parser) sourceLine(line int) string {
+	if parser.document == nil || parser.document.File != parser.currentFile {
+		return ""
+	}
+
+	return parser.document.Line(line)
+}
+
+// errorAt returns err with position in current file. err is returned as is
+// if it already has position.
+func (parser *Parser) errorAt(line int, column int, err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+
+	includes := make([]Position, len(parser.includes))
+	copy(includes, parser.includes)
+
+	return &Error{
+		File:     parser.currentFile,
+		Line:     line,
+		Column:   column,
+		Includes: includes,
+		Source:   parser.sourceLine(line),
+		Message:  errorMessage(err),
+		Err:      err,
+	}
+}
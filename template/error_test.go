@@ -0,0 +1,72 @@
+package template
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestErrorString(t *testing.T) {
+	tests := []struct {
+		err      *Error
+		expected string
+	}{
+		{&Error{File: "a.tt", Line: 12, Column: 5, Message: "msg"}, "a.tt:12:5: msg"},
+		{&Error{File: "a.tt", Line: 12, Message: "msg"}, "a.tt:12: msg"},
+		{&Error{File: "a.tt", Message: "msg"}, "a.tt: msg"},
+		{&Error{Message: "msg"}, "msg"},
+	}
+
+	for _, test := range tests {
+		if got := test.err.Error(); got != test.expected {
+			t.Errorf("Expected '%s' but got '%s'", test.expected, got)
+		}
+	}
+}
+
+func TestErrorExcerpt(t *testing.T) {
+	err := &Error{Source: "\t@file a.c $foo() @file_", Column: 12}
+	expected := "\t@file a.c $foo() @file_\n\t          ^\n"
+	if got := err.Excerpt(); got != expected {
+		t.Errorf("Expected %q but got %q", expected, got)
+	}
+
+	if got := (&Error{}).Excerpt(); got != "" {
+		t.Errorf("excerpt without source should be empty(got=%q)", got)
+	}
+}
+
+func TestErrorAt(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "test.tt")
+	doc, readErr := ReadDocument(file, strings.NewReader("first\nsecond\n"))
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+
+	parser.currentFile = file
+	parser.document = doc
+	parser.includes = []Position{{File: "main.tt", Line: 3}}
+
+	cause := errors.New("failed")
+	err := parser.errorAt(2, 4, cause)
+	if err.File != file || err.Line != 2 || err.Column != 4 || err.Source != "second" {
+		t.Errorf("unexpected position %#v", err)
+	}
+
+	if len(err.Includes) != 1 || err.Includes[0].File != "main.tt" || err.Includes[0].Line != 3 {
+		t.Errorf("include stack is not recorded(got=%v)", err.Includes)
+	}
+
+	if !errors.Is(err, cause) {
+		t.Error("original error is not wrapped")
+	}
+
+	if parser.errorAt(1, 1, err) != err {
+		t.Error("error which has position should not be wrapped again")
+	}
+}
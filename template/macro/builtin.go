@@ -0,0 +1,109 @@
+package macro
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// BuiltinFunc computes expansion of built-in macro from expanded arguments
+type BuiltinFunc func(args []string) (string, error)
+
+func formatInt(n *big.Int, prefix string, base int) string {
+	if n.Sign() < 0 {
+		return "-" + prefix + new(big.Int).Neg(n).Text(base)
+	}
+
+	return prefix + n.Text(base)
+}
+
+func intFormatter(prefix string, base int) BuiltinFunc {
+	return func(args []string) (string, error) {
+		n, err := EvalExpression(args[0])
+		if err != nil {
+			return "", err
+		}
+
+		return formatInt(n, prefix, base), nil
+	}
+}
+
+// maxRepeat limits result of $repeat not to exhaust memory by mistake
+const maxRepeat = 1 << 20
+
+func builtinRepeat(args []string) (string, error) {
+	n, err := EvalExpression(args[1])
+	if err != nil {
+		return "", err
+	}
+
+	if n.Sign() < 0 || n.Cmp(big.NewInt(maxRepeat)) > 0 {
+		return "", fmt.Errorf("repeat count %s is out of range(0 - %d)", n, maxRepeat)
+	}
+
+	return strings.Repeat(args[0], int(n.Int64())), nil
+}
+
+const ifName = "$if"
+
+// builtinIf is called only if $if is expanded with expanded arguments.
+// $if in macro body is expanded by evaluateIf, which doesn't expand the
+// branch not taken.
+func builtinIf(args []string) (string, error) {
+	cond, err := EvalExpression(args[0])
+	if err != nil {
+		return "", err
+	}
+
+	if cond.Sign() != 0 {
+		return args[1], nil
+	}
+
+	return args[2], nil
+}
+
+const foreachName = "$foreach"
+
+// builtinForeach is never called because $foreach is expanded by
+// evaluateForeach before its arguments are expanded
+func builtinForeach(args []string) (string, error) {
+	return "", fmt.Errorf("must be called with arguments")
+}
+
+type builtin struct {
+	name string
+	args []string
+	fn   BuiltinFunc
+}
+
+var builtins = []builtin{
+	{"$eval", []string{"$expr"}, intFormatter("", 10)},
+	{"$hex", []string{"$expr"}, intFormatter("0x", 16)},
+	{"$oct", []string{"$expr"}, intFormatter("0", 8)},
+	{"$bin", []string{"$expr"}, intFormatter("0b", 2)},
+	{"$repeat", []string{"$text", "$count"}, builtinRepeat},
+	{ifName, []string{"$cond", "$then", "$else"}, builtinIf},
+	{foreachName, []string{"$var", "$list", "$body", "$separator"}, builtinForeach},
+}
+
+// RegisterBuiltins registers built-in macros into env.
+//
+//	$eval(EXPR)         value of integer expression in decimal
+//	$hex(EXPR)          value of integer expression in hexadecimal (0x...)
+//	$oct(EXPR)          value of integer expression in octal (0...)
+//	$bin(EXPR)          value of integer expression in binary (0b...)
+//	$repeat(TEXT, N)    TEXT repeated N times
+//	$if(EXPR, A, B)     A if value of EXPR is not 0, otherwise B
+//	$foreach($v, LIST, BODY[, SEP])
+//	                    BODY expanded for each item of LIST with $v bound
+//	                    to the item, joined by SEP (default newline).
+//	                    Spaces around SEP are removed like other arguments
+//
+// EXPR is evaluated by EvalExpression. Only the selected one of A and B of
+// $if is expanded, so $if can guard macros which may not be defined. LIST is comma separated like rest
+// arguments of variadic macro, and BODY is expanded once per item.
+func RegisterBuiltins(env map[string]*Macro) {
+	for _, b := range builtins {
+		env[b.name] = &Macro{Name: b.name, DummyArgs: b.args, Builtin: b.fn}
+	}
+}
@@ -0,0 +1,64 @@
+package macro
+
+import (
+	"testing"
+)
+
+func TestBuiltins(t *testing.T) {
+	env := make(map[string]*Macro)
+	RegisterBuiltins(env)
+	env["$INTMAX"] = &Macro{Name: "$INTMAX", Body: "2147483647"}
+	env["$INTMIN"] = &Macro{Name: "$INTMIN", Body: "(-2147483647-1)"}
+	env["$LONG"] = &Macro{Name: "$LONG", Body: "64"}
+
+	tests := []struct {
+		body     string
+		expected string
+	}{
+		{"$eval($INTMAX - 1)", "2147483646"},
+		{"$eval($INTMIN)", "-2147483648"},
+		{"$hex($INTMAX)", "0x7fffffff"},
+		{"$hex(-255)", "-0xff"},
+		{"$oct(8)", "010"},
+		{"$bin(5)", "0b101"},
+		{"$repeat(ab, 3)", "ababab"},
+		{"$repeat([a, ], 1 + 1)", "a,a,"},
+		{"$repeat(x, 0)", ""},
+		{"$if($LONG == 64, long, long long)", "long"},
+		{"$if($LONG == 32, long, [long long])", "long long"},
+		{"$if($LONG == 64, $INTMAX, $UNDEFINED)", "2147483647"},
+		{"$if($LONG != 64, $UNDEFINED, $eval(1 + 1))", "2"},
+		{"$hex($eval($INTMAX + 1))", "0x80000000"},
+		{"$foreach($v, [1, 2, 3], x += $v;)", "x += 1;\nx += 2;\nx += 3;"},
+		{"$foreach($v, [1, [2, 3]], f($v), +)", "f(1)+f(2, 3)"},
+		{"$foreach($v, [], $v)", ""},
+		{"$foreach($t, [char, short], $foreach($v, [0, 1], ($t)$v, [, ]))", "(char)0,(char)1\n(short)0,(short)1"},
+	}
+
+	for _, test := range tests {
+		m := &Macro{Name: "test", Body: test.body}
+		got, err := m.Evaluate(nil, env)
+		if err != nil {
+			t.Errorf("%s: %s", test.body, err)
+			continue
+		}
+
+		if got != test.expected {
+			t.Errorf("%s: Expected '%s' but got '%s'", test.body, test.expected, got)
+		}
+	}
+}
+
+func TestBuiltinErrors(t *testing.T) {
+	env := make(map[string]*Macro)
+	RegisterBuiltins(env)
+
+	invalids := []string{"$eval(1 +)", "$eval(1, 2)", "$repeat(a, -1)", "$if(x, a, b)", "$if(1, a)", "$if(0, a, $UNDEFINED)", "$hex()",
+		"$foreach(v, [1], $v)", "$foreach($v, [1])"}
+	for _, body := range invalids {
+		m := &Macro{Name: "test", Body: body}
+		if got, err := m.Evaluate(nil, env); err == nil {
+			t.Errorf("'%s' is invalid but error is not returned(got=%s)", body, got)
+		}
+	}
+}
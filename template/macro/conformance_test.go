@@ -0,0 +1,85 @@
+package macro
+
+import (
+	"testing"
+)
+
+// conformanceEnv is environment shared by conformance tests
+func conformanceEnv() map[string]*Macro {
+	env := make(map[string]*Macro)
+	env["$INT"] = &Macro{Name: "$INT", Body: "32"}
+	env["$INTMAX"] = &Macro{Name: "$INTMAX", Body: "2147483647"}
+	env["$INTMIN"] = &Macro{Name: "$INTMIN", Body: "(-2147483647-1)"}
+	env["$UINTMAX"] = &Macro{Name: "$UINTMAX", Body: "4294967295U"}
+	env["$empty"] = &Macro{Name: "$empty", Body: ""}
+	env["$literal"] = &Macro{Name: "$literal", Body: "int x;"}
+	env["$assign"] = &Macro{Name: "$assign", Body: "$var = $val;",
+		DummyArgs: []string{"$var", "$val"}}
+	env["$lines"] = &Macro{Name: "$lines", Body: "int a = $v;\nint b = $v;\n",
+		DummyArgs: []string{"$v"}}
+	return env
+}
+
+func TestConformance(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{"empty body", "", ""},
+		{"literal body", "int main(void) { return 0; }", "int main(void) { return 0; }"},
+		{"literal macro", "$literal", "int x;"},
+		{"empty macro", "[$empty]", "[]"},
+		{"literal multi-line body", "int a;\n\nint b;\n", "int a;\n\nint b;\n"},
+		{"shorter name first", "$INT $INTMAX", "32 2147483647"},
+		{"longer name first", "$INTMAX $INT", "2147483647 32"},
+		{"name as prefix of other", "$UINTMAX $INTMAX $INTMIN $INT", "4294967295U 2147483647 (-2147483647-1) 32"},
+		{"adjacent macros", "$INT$INT", "3232"},
+		{"name followed by text", "$INT_t", "32_t"},
+		{"same macro twice", "$INTMAX == $INTMAX", "2147483647 == 2147483647"},
+		{"macro in string literal", `printf("%d\n", $INT);`, `printf("%d\n", 32);`},
+		{"dollar in replacement", `$assign(x, ${1})`, "x = ${1};"},
+		{"regexp meta in replacement", `$assign(s, "a.*(b)$")`, `s = "a.*(b)$";`},
+		{"multi-line expansion", "$lines(1)", "int a = 1;\nint b = 1;\n"},
+		{"multi-line arguments", "$assign(\n  x,\n  $INTMIN\n)", "x = (-2147483647-1);"},
+		{"parentheses are text", "($INT)", "(32)"},
+		{"lone dollar", "$ $", "$ $"},
+		{"ignored expression", "/* $Id$ */", "/* $Id$ */"},
+	}
+
+	env := conformanceEnv()
+	for _, test := range tests {
+		m := &Macro{Name: "test", Body: test.body}
+		got, err := m.Evaluate(nil, env)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		if got != test.expected {
+			t.Errorf("%s: Expected %q but got %q", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestConformanceErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"undefined macro", "$undefined"},
+		{"too few arguments", "$assign(x)"},
+		{"too many arguments", "$assign(x, 1, 2)"},
+		{"arguments for object like macro", "$INT(1)"},
+		{"unterminated arguments", "$assign(x, 1"},
+		{"unterminated string", `$assign(x, "1)`},
+	}
+
+	env := conformanceEnv()
+	for _, test := range tests {
+		m := &Macro{Name: "test", Body: test.body}
+		if got, err := m.Evaluate(nil, env); err == nil {
+			t.Errorf("%s: error is not returned(got=%q)", test.name, got)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package macro
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// value of expression is integer or string. Strings can be compared only.
+type value struct {
+	num   *big.Int
+	str   string
+	isStr bool
+}
+
+func intValue(n *big.Int) *value {
+	return &value{num: n}
+}
+
+func boolValue(b bool) *value {
+	if b {
+		return intValue(big.NewInt(1))
+	}
+	return intValue(big.NewInt(0))
+}
+
+type exprTokenKind int
+
+const (
+	exprNumber exprTokenKind = iota
+	exprString
+	exprOperator
+	exprEOF
+)
+
+type exprToken struct {
+	kind exprTokenKind
+	text string
+	num  *big.Int
+}
+
+// operators sorted by length so that longest one is matched
+var exprOperators = []string{
+	"<<", ">>", "<=", ">=", "==", "!=", "&&", "||",
+	"+", "-", "*", "/", "%", "<", ">", "&", "^", "|", "~", "!", "(", ")",
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isNumberChar(c byte) bool {
+	return isNameChar(c) || c == '_'
+}
+
+// parseIntLiteral parses C integer literal. Suffixes such as 'U', 'L' and
+// 'LL' are ignored. (ex 42, 0x2aUL, 052, 0b101010)
+func parseIntLiteral(literal string) (*big.Int, error) {
+	digits := strings.TrimRight(literal, "uUlL")
+	base := 10
+	switch {
+	case strings.HasPrefix(digits, "0x") || strings.HasPrefix(digits, "0X"):
+		digits, base = digits[2:], 16
+	case strings.HasPrefix(digits, "0b") || strings.HasPrefix(digits, "0B"):
+		digits, base = digits[2:], 2
+	case len(digits) > 1 && digits[0] == '0':
+		digits, base = digits[1:], 8
+	}
+
+	n, ok := new(big.Int).SetString(digits, base)
+	if !ok {
+		return nil, fmt.Errorf("invalid integer literal '%s'", literal)
+	}
+
+	return n, nil
+}
+
+func lexExpression(input string) ([]exprToken, error) {
+	tokens := make([]exprToken, 0)
+
+	for i := 0; i < len(input); {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case isDigit(c):
+			end := i
+			for end < len(input) && isNumberChar(input[end]) {
+				end++
+			}
+
+			n, err := parseIntLiteral(input[i:end])
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, exprToken{kind: exprNumber, text: input[i:end], num: n})
+			i = end
+		case c == '"':
+			end := i + 1
+			for end < len(input) && input[end] != '"' {
+				if input[end] == '\\' {
+					end++
+				}
+				end++
+			}
+
+			if end >= len(input) {
+				return nil, fmt.Errorf("unterminated string in expression '%s'", input)
+			}
+			tokens = append(tokens, exprToken{kind: exprString, text: input[i+1 : end]})
+			i = end + 1
+		default:
+			matched := ""
+			for _, op := range exprOperators {
+				if strings.HasPrefix(input[i:], op) {
+					matched = op
+					break
+				}
+			}
+
+			if matched == "" {
+				return nil, fmt.Errorf("unexpected character '%c' in expression '%s'", c, input)
+			}
+			tokens = append(tokens, exprToken{kind: exprOperator, text: matched})
+			i += len(matched)
+		}
+	}
+
+	return append(tokens, exprToken{kind: exprEOF}), nil
+}
+
+type exprParser struct {
+	input  string
+	tokens []exprToken
+	index  int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.index]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.tokens[p.index]
+	if t.kind != exprEOF {
+		p.index++
+	}
+	return t
+}
+
+func (p *exprParser) accept(ops ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != exprOperator {
+		return "", false
+	}
+
+	for _, op := range ops {
+		if t.text == op {
+			p.next()
+			return op, true
+		}
+	}
+
+	return "", false
+}
+
+// binary operators from lowest precedence
+var binaryPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// EvalExpression evaluates C like integer expression with arbitrary
+// precision. Operators of C except assignment, comma and conditional
+// operator are supported, and string literals can be compared by '==' and
+// '!='. Result of comparison is 1 or 0.
+func EvalExpression(input string) (*big.Int, error) {
+	v, err := evalValue(input)
+	if err != nil {
+		return nil, err
+	}
+
+	if v.isStr {
+		return nil, fmt.Errorf("expression '%s' is not integer", input)
+	}
+
+	return v.num, nil
+}
+
+func evalValue(input string) (*value, error) {
+	tokens, err := lexExpression(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{input: input, tokens: tokens}
+	v, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != exprEOF {
+		return nil, fmt.Errorf("unexpected '%s' in expression '%s'", t.text, input)
+	}
+
+	return v, nil
+}
+
+func (p *exprParser) parseBinary(level int) (*value, error) {
+	if level >= len(binaryPrecedence) {
+		return p.parseUnary()
+	}
+
+	lhs, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op, ok := p.accept(binaryPrecedence[level]...)
+		if !ok {
+			return lhs, nil
+		}
+
+		rhs, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		if lhs, err = p.applyBinary(op, lhs, rhs); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *exprParser) applyBinary(op string, lhs *value, rhs *value) (*value, error) {
+	if lhs.isStr || rhs.isStr {
+		if !lhs.isStr || !rhs.isStr {
+			return nil, fmt.Errorf("can't compare string and integer in expression '%s'", p.input)
+		}
+
+		switch op {
+		case "==":
+			return boolValue(lhs.str == rhs.str), nil
+		case "!=":
+			return boolValue(lhs.str != rhs.str), nil
+		default:
+			return nil, fmt.Errorf("operator '%s' can't be applied to strings in expression '%s'", op, p.input)
+		}
+	}
+
+	a, b := lhs.num, rhs.num
+	n := new(big.Int)
+	switch op {
+	case "||":
+		return boolValue(a.Sign() != 0 || b.Sign() != 0), nil
+	case "&&":
+		return boolValue(a.Sign() != 0 && b.Sign() != 0), nil
+	case "|":
+		n.Or(a, b)
+	case "^":
+		n.Xor(a, b)
+	case "&":
+		n.And(a, b)
+	case "==":
+		return boolValue(a.Cmp(b) == 0), nil
+	case "!=":
+		return boolValue(a.Cmp(b) != 0), nil
+	case "<":
+		return boolValue(a.Cmp(b) < 0), nil
+	case "<=":
+		return boolValue(a.Cmp(b) <= 0), nil
+	case ">":
+		return boolValue(a.Cmp(b) > 0), nil
+	case ">=":
+		return boolValue(a.Cmp(b) >= 0), nil
+	case "<<", ">>":
+		if b.Sign() < 0 || !b.IsInt64() || b.Int64() > 65536 {
+			return nil, fmt.Errorf("invalid shift count %s in expression '%s'", b, p.input)
+		}
+		if op == "<<" {
+			n.Lsh(a, uint(b.Int64()))
+		} else {
+			n.Rsh(a, uint(b.Int64()))
+		}
+	case "+":
+		n.Add(a, b)
+	case "-":
+		n.Sub(a, b)
+	case "*":
+		n.Mul(a, b)
+	case "/", "%":
+		if b.Sign() == 0 {
+			return nil, fmt.Errorf("division by zero in expression '%s'", p.input)
+		}
+		// truncated division like C
+		if op == "/" {
+			n.Quo(a, b)
+		} else {
+			n.Rem(a, b)
+		}
+	}
+
+	return intValue(n), nil
+}
+
+func (p *exprParser) parseUnary() (*value, error) {
+	op, ok := p.accept("+", "-", "~", "!")
+	if !ok {
+		return p.parsePrimary()
+	}
+
+	v, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	if v.isStr {
+		return nil, fmt.Errorf("operator '%s' can't be applied to string in expression '%s'", op, p.input)
+	}
+
+	switch op {
+	case "-":
+		return intValue(new(big.Int).Neg(v.num)), nil
+	case "~":
+		return intValue(new(big.Int).Not(v.num)), nil
+	case "!":
+		return boolValue(v.num.Sign() == 0), nil
+	default:
+		return v, nil
+	}
+}
+
+func (p *exprParser) parsePrimary() (*value, error) {
+	t := p.next()
+	switch t.kind {
+	case exprNumber:
+		return intValue(t.num), nil
+	case exprString:
+		return &value{str: t.text, isStr: true}, nil
+	case exprOperator:
+		if t.text == "(" {
+			v, err := p.parseBinary(0)
+			if err != nil {
+				return nil, err
+			}
+
+			if _, ok := p.accept(")"); !ok {
+				return nil, fmt.Errorf("missing ')' in expression '%s'", p.input)
+			}
+			return v, nil
+		}
+	}
+
+	if t.kind == exprEOF {
+		return nil, fmt.Errorf("unexpected end of expression '%s'", p.input)
+	}
+	return nil, fmt.Errorf("unexpected '%s' in expression '%s'", t.text, p.input)
+}
@@ -0,0 +1,58 @@
+package macro
+
+import (
+	"testing"
+)
+
+func TestEvalExpression(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{"1 + 2 * 3", "7"},
+		{"(1 + 2) * 3", "9"},
+		{"2147483647 - 1", "2147483646"},
+		{"(-2147483647-1)", "-2147483648"},
+		{"18446744073709551615ULL + 1", "18446744073709551616"},
+		{"9223372036854775807LL * 2", "18446744073709551614"},
+		{"0x7fffffffUL", "2147483647"},
+		{"017 + 0b11", "18"},
+		{"-7 / 2", "-3"},
+		{"-7 % 2", "-1"},
+		{"1 << 100", "1267650600228229401496703205376"},
+		{"-1 >> 1", "-1"},
+		{"~0", "-1"},
+		{"0xf0 | 0x0f ^ 0xff & 0x3c", "243"},
+		{"!0 + !5", "1"},
+		{"1 < 2 && 2 <= 2 || 0", "1"},
+		{"3 > 4 || 4 >= 5", "0"},
+		{"64 == 64", "1"},
+		{`"c++" == "c++"`, "1"},
+		{`"c" != "c++"`, "1"},
+	}
+
+	for _, test := range tests {
+		got, err := EvalExpression(test.expr)
+		if err != nil {
+			t.Errorf("%s: %s", test.expr, err)
+			continue
+		}
+
+		if got.String() != test.expected {
+			t.Errorf("%s: Expected %s but got %s", test.expr, test.expected, got)
+		}
+	}
+}
+
+func TestEvalExpressionErrors(t *testing.T) {
+	invalids := []string{
+		"", "1 +", "(1 + 2", "1 2", "1 / 0", "1 % 0", "1 << -1",
+		"0x", "09", "a + 1", `"c" < "d"`, `"c" == 1`, `"c`, `-"c"`,
+	}
+
+	for _, expr := range invalids {
+		if got, err := EvalExpression(expr); err == nil {
+			t.Errorf("'%s' is invalid but error is not returned(got=%s)", expr, got)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package macro
+
+type tokenKind int
+
+const (
+	tokenText tokenKind = iota
+	tokenMacro
+	tokenLeftParen
+	tokenRightParen
+	tokenLeftBracket
+	tokenRightBracket
+	tokenComma
+	tokenQuote
+	tokenEOF
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+var punctuations = map[byte]tokenKind{
+	'(':  tokenLeftParen,
+	')':  tokenRightParen,
+	'[':  tokenLeftBracket,
+	']':  tokenRightBracket,
+	',':  tokenComma,
+	'"':  tokenQuote,
+	'\'': tokenQuote,
+}
+
+func isNameChar(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+// isVariableName reports whether s is a macro or dummy argument name
+func isVariableName(s string) bool {
+	if len(s) < 2 || s[0] != '$' {
+		return false
+	}
+
+	for i := 1; i < len(s); i++ {
+		if !isNameChar(s[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// lex splits macro body into tokens. '\$' is escaped '$' and it is never
+// treated as start of macro expression. Backslash sequences are kept as is
+// in text tokens, so escaped '$' survives rescanning and is unescaped after
+// whole expansion. (see unescape)
+func lex(input string) []token {
+	tokens := make([]token, 0)
+	textStart := 0
+	text := make([]byte, 0)
+
+	flushText := func() {
+		if len(text) > 0 {
+			tokens = append(tokens, token{kind: tokenText, text: string(text), pos: textStart})
+			text = text[:0]
+		}
+	}
+
+	for i := 0; i < len(input); {
+		c := input[i]
+
+		if kind, ok := punctuations[c]; ok {
+			flushText()
+			tokens = append(tokens, token{kind: kind, text: input[i : i+1], pos: i})
+			i++
+			continue
+		}
+
+		if len(text) == 0 {
+			textStart = i
+		}
+
+		switch {
+		case c == '$' && i+1 < len(input) && isNameChar(input[i+1]):
+			flushText()
+			end := i + 1
+			for end < len(input) && isNameChar(input[end]) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenMacro, text: input[i:end], pos: i})
+			i = end
+		case c == '\\' && i+1 < len(input):
+			text = append(text, input[i:i+2]...)
+			i += 2
+		default:
+			text = append(text, c)
+			i++
+		}
+	}
+
+	flushText()
+	tokens = append(tokens, token{kind: tokenEOF, pos: len(input)})
+	return tokens
+}
+
+// unescape replaces '\$' with '$'. Other backslash sequences, such as escape
+// sequences in C string literals, are not changed.
+func unescape(input string) string {
+	output := make([]byte, 0, len(input))
+	for i := 0; i < len(input); i++ {
+		c := input[i]
+		if c == '\\' && i+1 < len(input) {
+			if input[i+1] != '$' {
+				output = append(output, c)
+			}
+			output = append(output, input[i+1])
+			i++
+			continue
+		}
+		output = append(output, c)
+	}
+
+	return string(output)
+}
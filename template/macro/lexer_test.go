@@ -0,0 +1,51 @@
+package macro
+
+import (
+	"testing"
+)
+
+func TestLex(t *testing.T) {
+	tokens := lex(`a $f(b, "c") \$d \n`)
+
+	expected := []struct {
+		kind tokenKind
+		text string
+	}{
+		{tokenText, "a "},
+		{tokenMacro, "$f"},
+		{tokenLeftParen, "("},
+		{tokenText, "b"},
+		{tokenComma, ","},
+		{tokenText, " "},
+		{tokenQuote, `"`},
+		{tokenText, "c"},
+		{tokenQuote, `"`},
+		{tokenRightParen, ")"},
+		{tokenText, ` \$d \n`},
+		{tokenEOF, ""},
+	}
+
+	if len(tokens) != len(expected) {
+		t.Fatalf("Expected %d tokens but got %d(%v)", len(expected), len(tokens), tokens)
+	}
+
+	for i, e := range expected {
+		if tokens[i].kind != e.kind || tokens[i].text != e.text {
+			t.Errorf("Expected token(%d, %q) but got (%d, %q) at %d",
+				e.kind, e.text, tokens[i].kind, tokens[i].text, i)
+		}
+	}
+}
+
+func TestLexDollarWithoutName(t *testing.T) {
+	tokens := lex(`$ 1 $`)
+	if len(tokens) != 2 || tokens[0].kind != tokenText || tokens[0].text != "$ 1 $" {
+		t.Errorf("'$' without name should be text(got=%v)", tokens)
+	}
+}
+
+func TestUnescape(t *testing.T) {
+	if got := unescape(`\$a "\n" \\$ \`); got != `$a "\n" \\$ \` {
+		t.Errorf("failed to unescape(got=%s)", got)
+	}
+}
@@ -0,0 +1,76 @@
+package macro
+
+import (
+	"strings"
+)
+
+// quoteListItem encloses item by brackets if it has commas which are not
+// enclosed by parentheses, brackets or quotes. Such item is not split by
+// SplitList.
+func quoteListItem(item string) string {
+	if len(SplitList(item)) > 1 {
+		return "[" + item + "]"
+	}
+
+	return item
+}
+
+// SplitList splits expanded text by commas like argument list of macro.
+// Brackets enclosing whole item are removed. (ex `1, [2, 3], f(4, 5)` =>
+// ["1", "2, 3", "f(4, 5)"])
+func SplitList(list string) []string {
+	items := make([]string, 0)
+	if strings.TrimSpace(list) == "" {
+		return items
+	}
+
+	depth := 0
+	quote := byte(0)
+	start := 0
+	for i := 0; i < len(list); i++ {
+		c := list[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(' || c == '[':
+			depth++
+		case c == ')' || c == ']':
+			depth--
+		case c == ',' && depth == 0:
+			items = append(items, unwrapListItem(list[start:i]))
+			start = i + 1
+		}
+	}
+
+	return append(items, unwrapListItem(list[start:]))
+}
+
+func unwrapListItem(item string) string {
+	item = strings.Trim(item, spaces)
+	if len(item) < 2 || item[0] != '[' || item[len(item)-1] != ']' {
+		return item
+	}
+
+	// '[a], [b]' is not enclosed by one bracket pair
+	depth := 0
+	for i := 0; i < len(item)-1; i++ {
+		switch item[i] {
+		case '[', '(':
+			depth++
+		case ']', ')':
+			depth--
+		}
+
+		if depth == 0 {
+			return item
+		}
+	}
+
+	return strings.Trim(item[1:len(item)-1], spaces)
+}
@@ -0,0 +1,38 @@
+package macro
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitList(t *testing.T) {
+	tests := []struct {
+		list     string
+		expected []string
+	}{
+		{"", []string{}},
+		{"a", []string{"a"}},
+		{" 1 , 2 ,3 ", []string{"1", "2", "3"}},
+		{"1, [2, 3], f(4, 5)", []string{"1", "2, 3", "f(4, 5)"}},
+		{`"a, b", 'c'`, []string{`"a, b"`, `'c'`}},
+		{"[a], [b]", []string{"a", "b"}},
+		{"[a] + [b]", []string{"[a] + [b]"}},
+	}
+
+	for _, test := range tests {
+		got := SplitList(test.list)
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("'%s': Expected %q but got %q", test.list, test.expected, got)
+		}
+	}
+}
+
+func TestQuoteListItem(t *testing.T) {
+	if got := quoteListItem("f(1, 2)"); got != "f(1, 2)" {
+		t.Errorf("item without top level comma should not be quoted(got=%s)", got)
+	}
+
+	if got := quoteListItem("1, 2"); got != "[1, 2]" {
+		t.Errorf("item with top level comma should be quoted(got=%s)", got)
+	}
+}
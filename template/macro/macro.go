@@ -1,15 +1,22 @@
 package macro
 
 import (
-	"regexp"
 	"fmt"
 	"strings"
 )
 
 type Macro struct {
-	Name string
-	Body string
+	Name      string
+	Body      string
 	DummyArgs []string
+
+	// Defaults has default values of trailing dummy arguments. Last dummy
+	// argument of variadic macro is bound to rest arguments joined by ", ".
+	Defaults map[string]string
+	Variadic bool
+
+	// Builtin is called instead of expanding Body if it is not nil
+	Builtin BuiltinFunc
 }
 
 var ignored_expressions = []string{"$Id"}
@@ -24,79 +31,402 @@ func isIgnoredExpression(expression string) bool {
 	return false
 }
 
-var dollarRegex = regexp.MustCompile(`\$`)
+// DefaultMaxDepth is maximum depth of nested macro expansion used if
+// Expander.MaxDepth is not specified
+const DefaultMaxDepth = 100
+
+// Expander expands macros in Env. File and Line are position of outermost
+// macro call in template and they are used for error messages.
+type Expander struct {
+	Env      map[string]*Macro
+	MaxDepth int
+	File     string
+	Line     int
+}
+
+// ExpansionError is returned when macro expansion recurses infinitely or
+// is too deep
+type ExpansionError struct {
+	Chain   []string
+	File    string
+	Line    int
+	Message string
+}
+
+func (err *ExpansionError) Error() string {
+	msg := fmt.Sprintf("%s: %s", err.Message, strings.Join(err.Chain, " -> "))
+	if err.File == "" {
+		return msg
+	}
 
-func escapeRegexpString(regexpStr string) string {
-	return fmt.Sprintf(`\Q%s\E`, regexpStr)
+	return fmt.Sprintf("%s:%d: %s", err.File, err.Line, msg)
 }
 
-// macroExpressionRegexp matches expression in macro. (ex $foo(bar, baz))
-// $1='macro name', $2='macro arguments'
-var macroExpressionRegexp = regexp.MustCompile(`(\$[a-zA-Z0-9]+)(?:\(([^)]*)\))?`)
+// expansion is state of one expansion. chain is names of macros which are
+// being expanded.
+type expansion struct {
+	expander *Expander
+	chain    []string
+}
 
-var spaceRegexp = regexp.MustCompile(`[\s\r\n]+`)
-func removeAllSpaces(arg string) string {
-	return spaceRegexp.ReplaceAllString(arg, "")
+func (macro *Macro) Evaluate(args []string, env map[string]*Macro) (string, error) {
+	expander := &Expander{Env: env}
+	return expander.Expand(macro, args)
 }
 
-func (macro *Macro)Evaluate(args []string, env map[string]*Macro) (string, error) {
+// Expand evaluates macro with args. Expansion follows rules similar to
+// the C preprocessor:
+//
+//  1. Each argument is fully expanded before it is substituted
+//  2. Dummy arguments in macro body are replaced with expanded arguments
+//  3. Result is rescanned and macros in it are expanded until no macro
+//     remains. Macros being expanded must not appear again in rescanning.
+//
+// Macro which has dummy arguments is not expanded if its name is not
+// followed by argument list, so it can be passed to other macros.
+//
+// '\$' is never expanded and it is replaced with '$' at last.
+func (expander *Expander) Expand(macro *Macro, args []string) (string, error) {
+	e := &expansion{expander: expander, chain: make([]string, 0)}
+
+	expandedArgs := make([]string, 0, len(args))
+	for _, arg := range args {
+		expanded, err := e.expandText(arg)
+		if err != nil {
+			return "", err
+		}
+		expandedArgs = append(expandedArgs, expanded)
+	}
 
-	if len(macro.DummyArgs) != len(args) {
-		err := fmt.Errorf("[%s]argument length is not be matched(expected=%d, got=%d)",
-			macro.Name, len(macro.DummyArgs), len(args))
+	expanded, err := e.evaluate(macro, expandedArgs)
+	if err != nil {
 		return "", err
 	}
 
-	bindings := make(map[string]string)
-	for i, arg := range args {
-		dummy := macro.DummyArgs[i]
-		bindings[dummy] = arg;
-	}
-
-	matcheds := macroExpressionRegexp.FindAllStringSubmatch(macro.Body, -1)
-	if len(matcheds) == 0 {
-		return "", nil
-	}
-
-	retval := macro.Body
-	for _, matched := range matcheds {
-		name := matched[1]
-
-		var expanded string
-		if val, ok := bindings[name]; ok {
-			expanded = val
-		} else if val, ok := env[name]; ok {
-			var args []string
-			if matched[2] == "" {
-				args = nil
-			} else {
-				argsStr := removeAllSpaces(matched[2])
-				args = strings.Split(argsStr, ",")
-			}
+	return unescape(expanded), nil
+}
+
+// expandText expands macros in text until it has no macro to expand
+func (e *expansion) expandText(text string) (string, error) {
+	for i := 0; ; i++ {
+		nodes, err := parseBody(text)
+		if err != nil {
+			return "", err
+		}
+
+		if !e.hasExpandableCall(nodes) {
+			return text, nil
+		}
+
+		if i >= e.maxDepth() {
+			return "", e.newError(text, "macro expansion does not terminate")
+		}
+
+		if text, err = e.evaluateNodes(nodes, nil); err != nil {
+			return "", err
+		}
+	}
+}
 
-			var err error
-			if len(val.DummyArgs) == 0 {
-				expanded = val.Body
-			} else {
-				expanded, err = val.Evaluate(args, env)
-				if err != nil {
-					return "", err
+func (e *expansion) isExpandable(call *callNode) bool {
+	if isIgnoredExpression(call.name) {
+		return false
+	}
+
+	m, ok := e.expander.Env[call.name]
+	return !ok || call.called || len(m.DummyArgs) == 0
+}
+
+func (e *expansion) hasExpandableCall(nodes []node) bool {
+	for _, n := range nodes {
+		if call, ok := n.(*callNode); ok && e.isExpandable(call) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (e *expansion) maxDepth() int {
+	if e.expander.MaxDepth > 0 {
+		return e.expander.MaxDepth
+	}
+
+	return DefaultMaxDepth
+}
+
+func (e *expansion) newError(name string, message string) error {
+	chain := make([]string, len(e.chain), len(e.chain)+1)
+	copy(chain, e.chain)
+
+	return &ExpansionError{
+		Chain:   append(chain, name),
+		File:    e.expander.File,
+		Line:    e.expander.Line,
+		Message: message,
+	}
+}
+
+// argumentRange returns minimum and maximum number of arguments. Maximum is
+// -1 if macro is variadic.
+func (macro *Macro) argumentRange() (int, int) {
+	fixed := macro.DummyArgs
+	if macro.Variadic {
+		fixed = fixed[:len(fixed)-1]
+	}
+
+	min := len(fixed)
+	for min > 0 {
+		if _, ok := macro.Defaults[fixed[min-1]]; !ok {
+			break
+		}
+		min--
+	}
+
+	if macro.Variadic {
+		return min, -1
+	}
+
+	return min, len(fixed)
+}
+
+func (macro *Macro) checkArgumentLength(length int) error {
+	min, max := macro.argumentRange()
+	if length >= min && (max < 0 || length <= max) {
+		return nil
+	}
+
+	var expected string
+	switch {
+	case max < 0:
+		expected = fmt.Sprintf("%d or more", min)
+	case min == max:
+		expected = fmt.Sprintf("%d", min)
+	default:
+		expected = fmt.Sprintf("%d-%d", min, max)
+	}
+
+	return fmt.Errorf("[%s]argument length is not be matched(expected=%s, got=%d)",
+		macro.Name, expected, length)
+}
+
+func (e *expansion) bindArguments(macro *Macro, args []string) (map[string]string, error) {
+	bindings := make(map[string]string)
+	for i, dummy := range macro.DummyArgs {
+		if macro.Variadic && i == len(macro.DummyArgs)-1 {
+			rest := make([]string, 0)
+			if i < len(args) {
+				for _, arg := range args[i:] {
+					rest = append(rest, quoteListItem(arg))
 				}
 			}
-		} else {
-			if !isIgnoredExpression(name) {
-				return "", fmt.Errorf("'%s' is not defined macro", name)
-			}
+			bindings[dummy] = strings.Join(rest, ", ")
+			break
+		}
+
+		if i < len(args) {
+			bindings[dummy] = args[i]
 			continue
 		}
 
-		replacedRegexp, err := regexp.Compile(regexp.QuoteMeta(matched[0]))
+		value, err := e.expandText(macro.Defaults[dummy])
+		if err != nil {
+			return nil, err
+		}
+		bindings[dummy] = value
+	}
+
+	return bindings, nil
+}
+
+func (e *expansion) evaluate(macro *Macro, args []string) (string, error) {
+	for _, name := range e.chain {
+		if name == macro.Name {
+			return "", e.newError(macro.Name, "recursive macro expansion")
+		}
+	}
+
+	if len(e.chain) >= e.maxDepth() {
+		return "", e.newError(macro.Name,
+			fmt.Sprintf("macro expansion is too deep(max=%d)", e.maxDepth()))
+	}
+
+	if err := macro.checkArgumentLength(len(args)); err != nil {
+		return "", err
+	}
+
+	if macro.Builtin != nil {
+		expanded, err := macro.Builtin(args)
+		if err != nil {
+			return "", fmt.Errorf("[%s]%s", macro.Name, err)
+		}
+		return expanded, nil
+	}
+
+	bindings, err := e.bindArguments(macro, args)
+	if err != nil {
+		return "", err
+	}
+
+	nodes, err := parseBody(macro.Body)
+	if err != nil {
+		return "", fmt.Errorf("[%s]%s", macro.Name, err)
+	}
+
+	e.chain = append(e.chain, macro.Name)
+	defer func() { e.chain = e.chain[:len(e.chain)-1] }()
+
+	expanded, err := e.evaluateNodes(nodes, bindings)
+	if err != nil {
+		return "", err
+	}
+
+	// rescan
+	return e.expandText(expanded)
+}
+
+func (e *expansion) evaluateNodes(nodes []node, bindings map[string]string) (string, error) {
+	var expanded strings.Builder
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case textNode:
+			expanded.WriteString(string(n))
+		case *callNode:
+			value, err := e.evaluateCall(n, bindings)
+			if err != nil {
+				return "", err
+			}
+			expanded.WriteString(value)
+		}
+	}
+
+	return expanded.String(), nil
+}
+
+func (e *expansion) evaluateArguments(call *callNode, bindings map[string]string) ([]string, error) {
+	if !call.called {
+		return nil, nil
+	}
+
+	args := make([]string, 0, len(call.args))
+	for _, arg := range call.args {
+		value, err := e.evaluateNodes(arg.nodes, bindings)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, value)
+	}
+
+	return args, nil
+}
+
+// evaluateForeach expands '$foreach($v, LIST, BODY[, SEP])'. BODY is not
+// expanded before $v is bound, so it is evaluated here instead of builtin.
+func (e *expansion) evaluateForeach(call *callNode, bindings map[string]string) (string, error) {
+	if len(call.args) < 3 || len(call.args) > 4 {
+		return "", fmt.Errorf("[%s]argument length is not be matched(expected=3-4, got=%d)",
+			foreachName, len(call.args))
+	}
+
+	variable := call.args[0].raw
+	if !isVariableName(variable) {
+		return "", fmt.Errorf("[%s]invalid loop variable '%s'", foreachName, variable)
+	}
+
+	list, err := e.evaluateNodes(call.args[1].nodes, bindings)
+	if err != nil {
+		return "", err
+	}
+
+	separator := "\n"
+	if len(call.args) == 4 {
+		if separator, err = e.evaluateNodes(call.args[3].nodes, bindings); err != nil {
+			return "", err
+		}
+	}
+
+	items := SplitList(list)
+	expanded := make([]string, 0, len(items))
+	for _, item := range items {
+		loopBindings := make(map[string]string, len(bindings)+1)
+		for name, value := range bindings {
+			loopBindings[name] = value
+		}
+		loopBindings[variable] = item
+
+		value, err := e.evaluateNodes(call.args[2].nodes, loopBindings)
 		if err != nil {
 			return "", err
 		}
+		expanded = append(expanded, value)
+	}
+
+	return strings.Join(expanded, separator), nil
+}
+
+// evaluateIf expands '$if(EXPR, A, B)'. Only the selected one of A and B is
+// expanded, so the other one can use macros which are not defined.
+func (e *expansion) evaluateIf(m *Macro, call *callNode, bindings map[string]string) (string, error) {
+	if err := m.checkArgumentLength(len(call.args)); err != nil {
+		return "", err
+	}
+
+	condition, err := e.evaluateNodes(call.args[0].nodes, bindings)
+	if err != nil {
+		return "", err
+	}
 
-		retval = replacedRegexp.ReplaceAllString(retval, expanded)
+	value, err := EvalExpression(condition)
+	if err != nil {
+		return "", fmt.Errorf("[%s]%s", ifName, err)
+	}
+
+	if value.Sign() != 0 {
+		return e.evaluateNodes(call.args[1].nodes, bindings)
+	}
+
+	return e.evaluateNodes(call.args[2].nodes, bindings)
+}
+
+func (e *expansion) evaluateCall(call *callNode, bindings map[string]string) (string, error) {
+	if call.name == foreachName && call.called {
+		if _, ok := e.expander.Env[foreachName]; ok {
+			return e.evaluateForeach(call, bindings)
+		}
+	}
+
+	if call.name == ifName && call.called {
+		if m, ok := e.expander.Env[ifName]; ok && m.Builtin != nil {
+			return e.evaluateIf(m, call, bindings)
+		}
+	}
+
+	if value, ok := bindings[call.name]; ok {
+		if !call.called {
+			return value, nil
+		}
+
+		// dummy argument followed by parentheses. (ex $func($a, $b))
+		args, err := e.evaluateArguments(call, bindings)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s(%s)", value, strings.Join(args, ", ")), nil
+	}
+
+	if !e.isExpandable(call) {
+		return call.source, nil
+	}
+
+	m, ok := e.expander.Env[call.name]
+	if !ok {
+		return "", fmt.Errorf("'%s' is not defined macro", call.name)
+	}
+
+	args, err := e.evaluateArguments(call, bindings)
+	if err != nil {
+		return "", err
 	}
 
-	return retval, nil
+	return e.evaluate(m, args)
 }
@@ -17,6 +17,80 @@ func TestWrongArgumentLength(t *testing.T) {
 	}
 }
 
+func TestDefaultArguments(t *testing.T) {
+	env := make(map[string]*Macro)
+	env["$ZERO"] = &Macro{Name: "$ZERO", Body: "0"}
+	m := &Macro{
+		Name:      "$f",
+		Body:      "$a $b $c",
+		DummyArgs: []string{"$a", "$b", "$c"},
+		Defaults:  map[string]string{"$b": "$ZERO", "$c": "x"},
+	}
+
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"1"}, "1 0 x"},
+		{[]string{"1", "2"}, "1 2 x"},
+		{[]string{"1", "2", "3"}, "1 2 3"},
+	}
+
+	for _, test := range tests {
+		got, err := m.Evaluate(test.args, env)
+		if err != nil {
+			t.Errorf("%v: %s", test.args, err)
+			continue
+		}
+
+		if got != test.expected {
+			t.Errorf("%v: Expected '%s' but got '%s'", test.args, test.expected, got)
+		}
+	}
+
+	for _, args := range [][]string{{}, {"1", "2", "3", "4"}} {
+		if _, err := m.Evaluate(args, env); err == nil {
+			t.Errorf("%v: wrong argument length but error is not returned", args)
+		}
+	}
+}
+
+func TestVariadicArguments(t *testing.T) {
+	env := make(map[string]*Macro)
+	RegisterBuiltins(env)
+	m := &Macro{
+		Name:      "$check",
+		Body:      "$type: $foreach($v, $vals, $type x = $v;, ;)",
+		DummyArgs: []string{"$type", "$vals"},
+		Variadic:  true,
+	}
+
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"int"}, "int: "},
+		{[]string{"int", "1"}, "int: int x = 1;"},
+		{[]string{"long", "1", "f(2, 3)", "4, 5"}, "long: long x = 1;;long x = f(2, 3);;long x = 4, 5;"},
+	}
+
+	for _, test := range tests {
+		got, err := m.Evaluate(test.args, env)
+		if err != nil {
+			t.Errorf("%v: %s", test.args, err)
+			continue
+		}
+
+		if got != test.expected {
+			t.Errorf("%v: Expected '%s' but got '%s'", test.args, test.expected, got)
+		}
+	}
+
+	if _, err := m.Evaluate(nil, env); err == nil {
+		t.Error("required argument is missing but error is not returned")
+	}
+}
+
 func TestEvaluate(t *testing.T) {
 	m := &Macro{Name: "foo", Body: `Hello $name`, DummyArgs: []string{"$name"}}
 	val, err := m.Evaluate([]string{"John"}, nil)
@@ -70,3 +144,174 @@ func TestEvaluateWithFunctionEnv(t *testing.T) {
 		t.Errorf("failed macro expantion with args(got=%s)", val)
 	}
 }
+
+func TestEvaluateNestedCall(t *testing.T) {
+	env := make(map[string]*Macro)
+	env["$add"] = &Macro{Name: "$add", Body: "($a + $b)", DummyArgs: []string{"$a", "$b"}}
+	env["$neg"] = &Macro{Name: "$neg", Body: "-$a", DummyArgs: []string{"$a"}}
+
+	m := &Macro{Name: "foo", Body: `x = $add($neg(1), $add(2, 3));`}
+	val, err := m.Evaluate(nil, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if val != "x = (-1 + (2 + 3));" {
+		t.Errorf("failed nested macro expantion(got=%s)", val)
+	}
+}
+
+func TestEvaluateStringArgument(t *testing.T) {
+	env := make(map[string]*Macro)
+	env["$print"] = &Macro{Name: "$print", Body: "puts($s);", DummyArgs: []string{"$s"}}
+
+	m := &Macro{Name: "foo", Body: `$print("John Smith, (Jr.)")`}
+	val, err := m.Evaluate(nil, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if val != `puts("John Smith, (Jr.)");` {
+		t.Errorf("spaces in string argument are broken(got=%s)", val)
+	}
+}
+
+func TestEvaluateEscapedDollar(t *testing.T) {
+	m := &Macro{Name: "foo", Body: `printf("\$name=%s\n", $name);`, DummyArgs: []string{"$name"}}
+	val, err := m.Evaluate([]string{`"John"`}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if val != `printf("$name=%s\n", "John");` {
+		t.Errorf("escaped '$' is expanded(got=%s)", val)
+	}
+}
+
+func TestEvaluateUndefinedMacro(t *testing.T) {
+	m := &Macro{Name: "foo", Body: `$undefined`}
+	if _, err := m.Evaluate(nil, nil); err == nil {
+		t.Error("undefined macro is used but error is not returned")
+	}
+
+	m = &Macro{Name: "foo", Body: `/* $Id: foo.c $ */`}
+	val, err := m.Evaluate(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if val != `/* $Id: foo.c $ */` {
+		t.Errorf("ignored expression is changed(got=%s)", val)
+	}
+}
+
+func TestRecursiveExpansion(t *testing.T) {
+	env := make(map[string]*Macro)
+	env["$a"] = &Macro{Name: "$a", Body: "a $b"}
+	env["$b"] = &Macro{Name: "$b", Body: "b $a"}
+
+	expander := &Expander{Env: env, File: "test.tt", Line: 12}
+	_, err := expander.Expand(env["$a"], nil)
+
+	expansionErr, ok := err.(*ExpansionError)
+	if !ok {
+		t.Fatalf("Expected ExpansionError but got %v", err)
+	}
+
+	if msg := expansionErr.Error(); msg != "test.tt:12: recursive macro expansion: $a -> $b -> $a" {
+		t.Errorf("unexpected error message(got=%s)", msg)
+	}
+}
+
+func TestSelfRecursiveExpansion(t *testing.T) {
+	env := make(map[string]*Macro)
+	env["$a"] = &Macro{Name: "$a", Body: "$a"}
+
+	if _, err := env["$a"].Evaluate(nil, env); err == nil {
+		t.Error("self recursive macro is expanded but error is not returned")
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	env := make(map[string]*Macro)
+	env["$a"] = &Macro{Name: "$a", Body: "$b"}
+	env["$b"] = &Macro{Name: "$b", Body: "$c"}
+	env["$c"] = &Macro{Name: "$c", Body: "c"}
+
+	expander := &Expander{Env: env, MaxDepth: 3}
+	if val, err := expander.Expand(env["$a"], nil); err != nil || val != "c" {
+		t.Errorf("Expected 'c' but got '%s'(%v)", val, err)
+	}
+
+	expander.MaxDepth = 2
+	_, err := expander.Expand(env["$a"], nil)
+	if expansionErr, ok := err.(*ExpansionError); !ok || len(expansionErr.Chain) != 3 {
+		t.Errorf("too deep expansion is not detected(got=%v)", err)
+	}
+}
+
+func TestSameMacroInArguments(t *testing.T) {
+	env := make(map[string]*Macro)
+	env["$add"] = &Macro{Name: "$add", Body: "($a + $b)", DummyArgs: []string{"$a", "$b"}}
+
+	m := &Macro{Name: "foo", Body: "$add($add(1, 2), 3)"}
+	val, err := m.Evaluate(nil, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if val != "((1 + 2) + 3)" {
+		t.Errorf("same macro in arguments is not expanded(got=%s)", val)
+	}
+}
+
+func TestExpansionSemantics(t *testing.T) {
+	env := make(map[string]*Macro)
+	env["$INTMAX"] = &Macro{Name: "$INTMAX", Body: "2147483647"}
+	env["$MAX"] = &Macro{Name: "$MAX", Body: "$INTMAX"}
+	env["$id"] = &Macro{Name: "$id", Body: "$x", DummyArgs: []string{"$x"}}
+	env["$call"] = &Macro{Name: "$call", Body: "$f(1)", DummyArgs: []string{"$f"}}
+	env["$twice"] = &Macro{Name: "$twice", Body: "$x + $x", DummyArgs: []string{"$x"}}
+	env["$dollar"] = &Macro{Name: "$dollar", Body: `\$MAX`}
+	env["$name"] = &Macro{Name: "$name", Body: "$INT"}
+	env["$INT"] = &Macro{Name: "$INT", Body: "32"}
+
+	tests := []struct {
+		body     string
+		args     []string
+		expected string
+	}{
+		// argument is expanded before substitution
+		{"$id($INTMAX)", nil, "2147483647"},
+		// argument given from caller is expanded
+		{"$y", []string{"$MAX"}, "2147483647"},
+		// macro in macro body is expanded to fixed point
+		{"$MAX", nil, "2147483647"},
+		// result is rescanned (macro name passed as argument)
+		{"$call([$id])", nil, "1"},
+		// argument is expanded only once even if it is used twice
+		{"$twice($MAX)", nil, "2147483647 + 2147483647"},
+		// escaped '$' is not expanded even if it is rescanned
+		{"$id($dollar)", nil, "$MAX"},
+		{`\$INTMAX`, nil, "$INTMAX"},
+		// result of expansion followed by text is not a new macro name
+		{"$name()MAX", nil, "32MAX"},
+	}
+
+	for _, test := range tests {
+		m := &Macro{Name: "test", Body: test.body}
+		if test.args != nil {
+			m.DummyArgs = []string{"$y"}
+		}
+
+		got, err := m.Evaluate(test.args, env)
+		if err != nil {
+			t.Errorf("%s: %s", test.body, err)
+			continue
+		}
+
+		if got != test.expected {
+			t.Errorf("%s: Expected '%s' but got '%s'", test.body, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package macro
+
+import (
+	"fmt"
+	"strings"
+)
+
+// node of macro body is textNode or *callNode
+type node interface{}
+
+type textNode string
+
+// callNode is macro expression. (ex $name, $name(arg1, [arg2, arg3]))
+type callNode struct {
+	name   string
+	args   []*argument
+	called bool // expression has argument list
+	source string
+	pos    int
+}
+
+type argument struct {
+	nodes []node
+	raw   string
+}
+
+type parser struct {
+	input  string
+	tokens []token
+	index  int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.index]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.index]
+	if t.kind != tokenEOF {
+		p.index++
+	}
+	return t
+}
+
+// parseBody parses macro body into nodes. Parentheses, brackets, commas and
+// quotes are just text out of argument list.
+func parseBody(input string) ([]node, error) {
+	p := &parser{input: input, tokens: lex(input)}
+
+	nodes := make([]node, 0)
+	for {
+		t := p.peek()
+		switch t.kind {
+		case tokenEOF:
+			return nodes, nil
+		case tokenMacro:
+			call, err := p.parseCall()
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, call)
+		default:
+			p.next()
+			nodes = append(nodes, textNode(t.text))
+		}
+	}
+}
+
+func (p *parser) parseCall() (*callNode, error) {
+	t := p.next()
+	call := &callNode{name: t.text, pos: t.pos}
+
+	end := t.pos + len(t.text)
+	if p.peek().kind == tokenLeftParen {
+		p.next()
+		call.called = true
+		call.args = make([]*argument, 0)
+
+		for {
+			arg, terminator, err := p.parseArgument(call)
+			if err != nil {
+				return nil, err
+			}
+
+			// '$f()' has no argument
+			if terminator.kind == tokenRightParen && len(call.args) == 0 && arg.raw == "" {
+				end = terminator.pos + 1
+				break
+			}
+
+			call.args = append(call.args, arg)
+			if terminator.kind == tokenRightParen {
+				end = terminator.pos + 1
+				break
+			}
+		}
+	}
+
+	call.source = p.input[call.pos:end]
+	return call, nil
+}
+
+// parseArgument reads one argument until ',' or ')' which is not enclosed
+// by parentheses, brackets or quotes. Argument enclosed by brackets is
+// unwrapped so that it can have commas. (ex [1, 2])
+func (p *parser) parseArgument(call *callNode) (*argument, token, error) {
+	nodes := make([]node, 0)
+	start := p.peek().pos
+	depth := 0
+	quote := ""
+
+	// position of bracket pair enclosing the argument
+	openIndex, closeIndex := -1, -1
+
+	for {
+		t := p.peek()
+		if t.kind == tokenEOF {
+			if quote != "" {
+				return nil, t, fmt.Errorf("[%s]unterminated string in argument", call.name)
+			}
+			return nil, t, fmt.Errorf("[%s]unterminated argument list", call.name)
+		}
+
+		if t.kind == tokenMacro {
+			nested, err := p.parseCall()
+			if err != nil {
+				return nil, t, err
+			}
+			nodes = append(nodes, nested)
+			continue
+		}
+		p.next()
+
+		if quote != "" {
+			if t.kind == tokenQuote && t.text == quote {
+				quote = ""
+			}
+			nodes = append(nodes, textNode(t.text))
+			continue
+		}
+
+		switch t.kind {
+		case tokenQuote:
+			quote = t.text
+		case tokenLeftParen, tokenLeftBracket:
+			if t.kind == tokenLeftBracket && depth == 0 && isBlank(nodes) {
+				openIndex = len(nodes)
+			}
+			depth++
+		case tokenRightParen, tokenRightBracket:
+			if depth == 0 {
+				if t.kind == tokenRightParen {
+					return newArgument(p.input[start:t.pos], nodes, openIndex, closeIndex), t, nil
+				}
+				return nil, t, fmt.Errorf("[%s]unbalanced ']' in argument", call.name)
+			}
+			depth--
+			if t.kind == tokenRightBracket && depth == 0 && openIndex >= 0 && closeIndex < 0 {
+				closeIndex = len(nodes)
+			}
+		case tokenComma:
+			if depth == 0 {
+				return newArgument(p.input[start:t.pos], nodes, openIndex, closeIndex), t, nil
+			}
+		}
+
+		nodes = append(nodes, textNode(t.text))
+	}
+}
+
+func isBlank(nodes []node) bool {
+	for _, n := range nodes {
+		text, ok := n.(textNode)
+		if !ok || strings.TrimSpace(string(text)) != "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+const spaces = " \t\r\n"
+
+func newArgument(raw string, nodes []node, openIndex int, closeIndex int) *argument {
+	raw = strings.Trim(raw, spaces)
+
+	if openIndex >= 0 && closeIndex >= 0 && isBlank(nodes[closeIndex+1:]) {
+		nodes = nodes[openIndex+1 : closeIndex]
+		raw = strings.Trim(raw[1:len(raw)-1], spaces)
+	}
+
+	return &argument{nodes: trimNodes(nodes), raw: raw}
+}
+
+// trimNodes removes spaces around argument
+func trimNodes(nodes []node) []node {
+	trimmed := make([]node, len(nodes))
+	copy(trimmed, nodes)
+
+	for len(trimmed) > 0 {
+		text, ok := trimmed[0].(textNode)
+		if !ok {
+			break
+		}
+
+		if s := strings.TrimLeft(string(text), spaces); s != "" {
+			trimmed[0] = textNode(s)
+			break
+		}
+		trimmed = trimmed[1:]
+	}
+
+	for len(trimmed) > 0 {
+		last := len(trimmed) - 1
+		text, ok := trimmed[last].(textNode)
+		if !ok {
+			break
+		}
+
+		if s := strings.TrimRight(string(text), spaces); s != "" {
+			trimmed[last] = textNode(s)
+			break
+		}
+		trimmed = trimmed[:last]
+	}
+
+	return trimmed
+}
+
+// ParseCall parses macro call string and returns macro name and raw
+// arguments. (ex `$f(1, [2, 3])` => "$f", ["1", "2, 3"])
+func ParseCall(input string) (string, []string, error) {
+	nodes, err := parseBody(strings.Trim(input, spaces))
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(nodes) != 1 {
+		return "", nil, fmt.Errorf("Invalid macro: '%s'", input)
+	}
+
+	call, ok := nodes[0].(*callNode)
+	if !ok || !call.called {
+		return "", nil, fmt.Errorf("Invalid macro: '%s'", input)
+	}
+
+	args := make([]string, 0, len(call.args))
+	for _, arg := range call.args {
+		args = append(args, arg.raw)
+	}
+
+	return call.name, args, nil
+}
@@ -0,0 +1,63 @@
+package macro
+
+import (
+	"testing"
+)
+
+func TestParseCall(t *testing.T) {
+	name, args, err := ParseCall(` $f($g(1, 2), "John Smith", [a, b], (c, d)) `)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name != "$f" {
+		t.Errorf("Expected '$f' but got '%s'", name)
+	}
+
+	expected := []string{"$g(1, 2)", `"John Smith"`, "a, b", "(c, d)"}
+	if len(args) != len(expected) {
+		t.Fatalf("Expected %v but got %v", expected, args)
+	}
+
+	for i, arg := range expected {
+		if args[i] != arg {
+			t.Errorf("Expected '%s' but got '%s'", arg, args[i])
+		}
+	}
+}
+
+func TestParseCallWithoutArgument(t *testing.T) {
+	name, args, err := ParseCall(`$f()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name != "$f" || len(args) != 0 {
+		t.Errorf("Expected '$f' without arguments but got %s%v", name, args)
+	}
+}
+
+func TestParseCallInvalid(t *testing.T) {
+	invalids := []string{`$f`, `f(1)`, `$f(1) $g(2)`, `$f(1`, `$f("1)`, `$f(1])`}
+	for _, input := range invalids {
+		if _, _, err := ParseCall(input); err == nil {
+			t.Errorf("'%s' is invalid but error is not returned", input)
+		}
+	}
+}
+
+func TestParseBodyQuotedComma(t *testing.T) {
+	nodes, err := parseBody(`$f("a, b)", 'c')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	call := nodes[0].(*callNode)
+	if len(call.args) != 2 {
+		t.Fatalf("Expected 2 arguments but got %d", len(call.args))
+	}
+
+	if call.args[0].raw != `"a, b)"` || call.args[1].raw != `'c'` {
+		t.Errorf("quoted arguments are broken(got=%s, %s)", call.args[0].raw, call.args[1].raw)
+	}
+}
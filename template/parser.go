@@ -1,12 +1,10 @@
 package template
 
 import (
-	"bufio"
-	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
-	"regexp"
 	"strings"
 
 	"path/filepath"
@@ -14,163 +12,194 @@ import (
 	"github.com/syohex/testgon/template/macro"
 )
 
+// Parser generates test files from templates. Files of '@include' are
+// searched in the following order:
+//
+//  1. directory of the including file
+//  2. IncludePaths in order
+//  3. directory of the template given to Parse
 type Parser struct {
 	IncludePaths     []string
+	IncludeTrace     io.Writer
+	TemplateEncoding string
+	OutputEncoding   string
+	Warnings         io.Writer
+	Skip             Category
+	MaxMacroDepth    int
+	skipped          int
 	predefined       map[string]*macro.Macro
+	env              map[string]*macro.Macro
+	definedIn        map[string]string
+	currentFile      string
+	document         *Document
+	includes         []Position
+	included         map[string]bool
 	filenameIndex    int
-	templateEncoding string
-	outputEncoding   string
 	outputDirectory  string
+
+	// dirs are output directories of '@dir' sections and their positions
+	dirs map[string]Position
+
+	// files are paths of generated files and positions of their '@file'
+	// sections
+	files map[string]Position
 }
 
 func NewParser(outputDir string, predefined map[string]*macro.Macro) *Parser {
 	parser := &Parser{
+		Warnings:         os.Stderr,
 		outputDirectory:  outputDir,
 		predefined:       predefined,
+		included:         make(map[string]bool),
+		dirs:             make(map[string]Position),
+		files:            make(map[string]Position),
 		filenameIndex:    0,
-		templateEncoding: "utf-8",
-		outputEncoding:   "utf-8",
+		TemplateEncoding: DefaultEncoding,
+		OutputEncoding:   DefaultEncoding,
 	}
 
 	return parser
 }
 
-var startSection = regexp.MustCompile(`^@([^_\s]+)`)
-var endSection = regexp.MustCompile(`^@([^_\s]+)_`)
+// Skipped returns number of files which are not generated because of
+// their category
+func (parser *Parser) Skipped() int {
+	return parser.skipped
+}
 
-func checkSyntax(file io.Reader) error {
-	type section struct {
-		name string
-		line int
-	}
+// SetFilenameIndex sets the number given to next file whose name has '???'
+// placeholders
+func (parser *Parser) SetFilenameIndex(index int) {
+	parser.filenameIndex = index
+}
 
-	scanner := bufio.NewScanner(file)
-	currentLine := 1
-
-	sections := make([]*section, 0)
-	currentSection := 0
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		if matched := endSection.FindStringSubmatch(line); matched != nil {
-			section := matched[1]
-
-			if currentSection == 0 {
-				return fmt.Errorf("found only '%s' end at %d",
-					section, currentLine)
-			}
-
-			lastSection := sections[currentSection-1].name
-			if section != lastSection {
-				return fmt.Errorf("missing end of '%s' section(at %d)",
-					lastSection, sections[currentSection-1].line)
-			}
-			currentSection--
-		} else if matched := startSection.FindStringSubmatch(line); matched != nil {
-			sectionName := matched[1]
-
-			re, err := regexp.Compile(`^@` + sectionName + `_\s*$`)
-			if err != nil {
-				return fmt.Errorf("can't create regexp object for '@%s'",
-					sectionName)
-			}
-			if !re.MatchString(line) { // End section directive is not same line
-				s := &section{
-					name: sectionName,
-					line: currentLine,
-				}
-
-				if currentSection < cap(sections) {
-					sections[currentSection] = s
-				} else {
-					sections = append(sections, s)
-				}
-				currentSection++
-			}
-		}
-		currentLine++
+// resetEnvironment drops macros defined by '@def' sections. Macros defined in
+// one template are visible in the rest of it and in files it includes (and
+// macros defined in included files are visible to the includer), but they
+// are not visible from other templates. Record of included files for
+// '@include:once' is also per template.
+func (parser *Parser) resetEnvironment() {
+	parser.env = make(map[string]*macro.Macro)
+	parser.included = make(map[string]bool)
+	for name, m := range parser.predefined {
+		parser.env[name] = m
 	}
+	parser.definedIn = make(map[string]string)
+}
 
-	if err := scanner.Err(); err != nil {
-		return err
+func (parser *Parser) environment() map[string]*macro.Macro {
+	if parser.env == nil {
+		parser.resetEnvironment()
 	}
 
-	if currentSection != 0 {
-		messages := make([]string, 0)
-
-		for i := 0; i < currentSection; i++ {
-			msg := fmt.Sprintf("'%s' section doesn't have end of section(at %d)",
-				sections[i].name, sections[i].line)
-			messages = append(messages, msg)
-		}
+	return parser.env
+}
 
-		return errors.New(strings.Join(messages, "\n"))
+func (parser *Parser) warn(format string, args ...interface{}) {
+	if parser.Warnings != nil {
+		fmt.Fprintf(parser.Warnings, "warning: "+format+"\n", args...)
 	}
+}
 
-	return nil
+// SyntaxError is returned when sections in template are not balanced
+type SyntaxError struct {
+	Line    int
+	Message string
+
+	// Source is text of Line if it is known
+	Source string
 }
 
-func (parser *Parser) parseTemplate(template io.Reader) error {
-	scanner := bufio.NewScanner(template)
+func (err *SyntaxError) Error() string {
+	return err.Message
+}
 
-	for scanner.Scan() {
-		line := scanner.Text()
+func newSyntaxError(line int, format string, args ...interface{}) error {
+	return &SyntaxError{Line: line, Message: fmt.Sprintf(format, args...)}
+}
 
-		matched := startSection.FindStringSubmatch(line)
-		if matched == nil {
-			continue
+// documentError returns error of reading document with its position
+func (parser *Parser) documentError(err error) error {
+	if syntaxErr, ok := err.(*SyntaxError); ok {
+		e := parser.errorAt(syntaxErr.Line, 1, err)
+		if e.Source == "" {
+			e.Source = syntaxErr.Source
 		}
+		return e
+	}
 
-		section := matched[1]
-		argument := matched[2]
-		callback := dispatchTable[section]
+	return err
+}
 
-		endRegexp, err := regexp.Compile(`^` + section + `_`)
-		if err != nil {
-			return errors.New("Can't create end regexp XXX")
-		}
+// parseDocument dispatches top level sections of doc to their handlers.
+// doc is used for source excerpts of errors while it is parsed.
+func (parser *Parser) parseDocument(doc *Document) error {
+	outer := parser.document
+	parser.document = doc
+	defer func() { parser.document = outer }()
+
+	return parser.parseSections(doc.Sections)
+}
 
-		lines := make([]string, 0)
-		for {
-			if endRegexp.MatchString(line) {
-				break
-			}
-			lines = append(lines, line)
+func (parser *Parser) parseSections(sections []*Section) error {
+	for _, section := range sections {
+		if err := parser.dispatch(section); err != nil {
+			return err
 		}
+	}
 
-		callback(parser, argument, strings.Join(lines, "\n"))
+	return nil
+}
+
+// dispatch calls handler of section. Errors of handler are returned with
+// position of the section.
+func (parser *Parser) dispatch(section *Section) error {
+	callback, ok := dispatchTable[section.Name]
+	if !ok {
+		return parser.errorAt(section.Line, 1, fmt.Errorf("unknown section '@%s'", section.Name))
 	}
 
-	if err := scanner.Err(); err != nil {
-		return err
+	if err := callback(parser, section); err != nil {
+		return parser.errorAt(section.Line, 1, err)
 	}
 
 	return nil
 }
 
-func (parser Parser) Parse(template string) error {
+func (parser *Parser) Parse(template string) error {
 	// Set directory in template file as default include path
 	abs, err := filepath.Abs(filepath.Dir(template))
 	if err != nil {
 		return err
 	}
 	parser.IncludePaths = append(parser.IncludePaths, abs)
+	defer func() {
+		// clean up default include path
+		parser.IncludePaths = parser.IncludePaths[:len(parser.IncludePaths)-1]
+	}()
+
+	parser.currentFile = template
+	parser.resetEnvironment()
 
-	file, err := os.Open(template)
+	doc, err := parser.loadDocument(template)
 	if err != nil {
-		return err
+		return parser.documentError(err)
 	}
-	defer file.Close()
 
-	if err := checkSyntax(file); err != nil {
-		return err
+	return parser.parseDocument(doc)
+}
+
+// loadDocument reads template file in TemplateEncoding
+func (parser *Parser) loadDocument(path string) (*Document, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := parser.parseTemplate(file); err != nil {
-		return err
+	text, err := decodeText(raw, parser.TemplateEncoding)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
 	}
 
-	// clean up default include path
-	parser.IncludePaths = parser.IncludePaths[:len(parser.IncludePaths)-1]
-	return nil
+	return ReadDocument(path, strings.NewReader(text))
 }
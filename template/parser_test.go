@@ -1,7 +1,19 @@
 package template
 
-import "testing"
-import "strings"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/syohex/testgon/manifest"
+	"github.com/syohex/testgon/template/macro"
+)
 
 func TestSectionRegexp(t *testing.T) {
 	if !startSection.MatchString(`@sample`) {
@@ -19,7 +31,7 @@ func TestCheckSyntaxSuccess(t *testing.T) {
 Ignore this section
 @comment_
 `)
-	if err := checkSyntax(reader); err != nil {
+	if _, err := ReadDocument("test.tt", reader); err != nil {
 		t.Errorf("syntax checker mistake '")
 	}
 }
@@ -32,7 +44,7 @@ Ignore this section
 @comment_
 @def_
 `)
-	if err := checkSyntax(reader); err != nil {
+	if _, err := ReadDocument("test.tt", reader); err != nil {
 		t.Errorf("syntax checker mistake for nested case'")
 	}
 }
@@ -41,7 +53,7 @@ func TestCheckSyntaxFailStartSectionOnly(t *testing.T) {
 	reader := strings.NewReader(`
 @start
 `)
-	if err := checkSyntax(reader); err == nil {
+	if _, err := ReadDocument("test.tt", reader); err == nil {
 		t.Errorf("syntax checker misses for only start section case")
 	}
 }
@@ -50,7 +62,7 @@ func TestCheckSyntaxFailEndSectionOnly(t *testing.T) {
 	reader := strings.NewReader(`
 @def_
 `)
-	if err := checkSyntax(reader); err == nil {
+	if _, err := ReadDocument("test.tt", reader); err == nil {
 		t.Errorf("syntax checker miss for only end section case")
 	}
 }
@@ -60,7 +72,495 @@ func TestCheckSyntaxFailInvalidEndSection(t *testing.T) {
 @foo
 @bar_
 `)
-	if err := checkSyntax(reader); err == nil {
+	if _, err := ReadDocument("test.tt", reader); err == nil {
 		t.Errorf("syntax checker miss invald end section")
 	}
 }
+
+func TestCheckSyntaxIfElse(t *testing.T) {
+	reader := strings.NewReader(`
+@if $LONG == 64
+@def $x
+1
+@def_
+@else
+@if $INT == 32
+@if_
+@if_
+`)
+	if _, err := ReadDocument("test.tt", reader); err != nil {
+		t.Errorf("syntax checker mistake for '@if' section: %s", err)
+	}
+}
+
+func TestCheckSyntaxFailElse(t *testing.T) {
+	invalids := []string{
+		"@else\n",
+		"@def $x\n@else\n@def_\n",
+		"@if 1\n@else\n@else\n@if_\n",
+		"@if\n@if_\n",
+	}
+
+	for _, input := range invalids {
+		if _, err := ReadDocument("test.tt", strings.NewReader(input)); err == nil {
+			t.Errorf("syntax checker misses invalid '@else' or '@if': %q", input)
+		}
+	}
+}
+
+func TestCheckSyntaxOneLineSection(t *testing.T) {
+	reader := strings.NewReader(`
+@dir test
+@file a.c $main(0) @file_
+@file b.c
+  $main(1)
+@file_
+@dir_
+`)
+	if _, err := ReadDocument("test.tt", reader); err != nil {
+		t.Errorf("syntax checker mistake for one line section: %s", err)
+	}
+}
+
+// parseText parses text as template in parser.currentFile
+func parseText(parser *Parser, text string) error {
+	doc, err := ReadDocument(parser.currentFile, strings.NewReader(text))
+	if err != nil {
+		return parser.documentError(err)
+	}
+
+	return parser.parseDocument(doc)
+}
+
+func TestParseTemplate(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	parser.predefined["$LONG"] = &macro.Macro{Name: "$LONG", Body: "64"}
+
+	template := `Text out of sections is ignored
+@comment
+@dir ignored
+@dir_
+@comment_
+@def $add($a, $b)
+$main($a + $b)
+@def_
+@if $LONG == 64
+@def $width
+64
+@def_
+@else
+@def $width
+32
+@def_
+@if_
+@dir test int
+@file sum.c $add(1, 2) @file_
+@file width.c
+  $main($width)
+@file_
+@dir_
+`
+	if err := parseText(parser, template); err != nil {
+		t.Fatal(err)
+	}
+
+	testDir := filepath.Join(dir, "test")
+	expected := map[string]string{
+		"sum.c":   "int main(void) { return 1 + 2; }\n",
+		"width.c": "int main(void) { return 64; }\n",
+	}
+	for file, content := range expected {
+		if got := readGeneratedFile(t, filepath.Join(testDir, file)); got != content {
+			t.Errorf("%s: Expected '%s' but got '%s'", file, content, got)
+		}
+	}
+
+	files, err := manifest.Read(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files.Entries) != 2 {
+		t.Errorf("Expected 2 files in manifest but got %v", files.Entries)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "ignored")); !os.IsNotExist(err) {
+		t.Error("section in comment should not be processed")
+	}
+}
+
+func TestParseTemplateInclude(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	included := filepath.Join(dir, "common.tt")
+	if err := ioutil.WriteFile(included, []byte("@def $one\n1\n@def_\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	parser.IncludePaths = []string{dir}
+
+	template := `@include common.tt @include_
+@dir test
+@file one.c $main($one) @file_
+@dir_
+`
+	if err := parseText(parser, template); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readGeneratedFile(t, filepath.Join(dir, "test", "one.c"))
+	if got != "int main(void) { return 1; }\n" {
+		t.Errorf("macro in included file is not expanded(got=%s)", got)
+	}
+}
+
+func TestParseTemplateUnknownSection(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	parser.currentFile = "test.tt"
+	err := parseText(parser, "\n@unknown\n@unknown_\n")
+	if err == nil {
+		t.Fatal("unknown section but error is not returned")
+	}
+
+	expected := "test.tt:2:1: unknown section '@unknown'"
+	if err.Error() != expected {
+		t.Errorf("Expected '%s' but got '%s'", expected, err.Error())
+	}
+}
+
+func TestParseTemplateHandlerError(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	parser.currentFile = "test.tt"
+	template := `@dir test
+@file a.c $undefined() @file_
+@dir_
+`
+	err := parseText(parser, template)
+	if err == nil {
+		t.Fatal("undefined macro but error is not returned")
+	}
+
+	var templateErr *Error
+	if !errors.As(err, &templateErr) {
+		t.Fatalf("error does not have position(got=%s)", err)
+	}
+
+	if templateErr.Line != 2 || templateErr.Column != 11 {
+		t.Errorf("Expected position 2:11 but got %d:%d", templateErr.Line, templateErr.Column)
+	}
+}
+
+func TestParseTemplateUnbalanced(t *testing.T) {
+	invalids := []string{"@def $x\n1\n", "@def_\n", "@if 1\n@if 1\n@if_\n"}
+	for _, template := range invalids {
+		parser, dir := testParser(t)
+		defer os.RemoveAll(dir)
+
+		err := parseText(parser, template)
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("Expected syntax error for %q but got %v", template, err)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	template := filepath.Join(dir, "test.tt")
+	content := "@dir test\n@file a.c $main(0) @file_\n@dir_\n"
+	if err := ioutil.WriteFile(template, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := parser.Parse(template); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readGeneratedFile(t, filepath.Join(dir, "test", "a.c"))
+	if got != "int main(void) { return 0; }\n" {
+		t.Errorf("file is not generated by Parse(got=%s)", got)
+	}
+}
+
+func TestParseSyntaxError(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	template := filepath.Join(dir, "test.tt")
+	if err := ioutil.WriteFile(template, []byte("\n@dir test\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := parser.Parse(template)
+	templateErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("Expected template error but got %v", err)
+	}
+
+	if templateErr.File != template || templateErr.Line != 2 || templateErr.Source != "@dir test" {
+		t.Errorf("unexpected error %#v", templateErr)
+	}
+}
+
+func writeTemplates(t *testing.T, dir string, templates map[string]string) {
+	for name, content := range templates {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestParseIncludeCycle(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	writeTemplates(t, dir, map[string]string{
+		"a.tt": "@include b.tt @include_\n",
+		"b.tt": "\n@include a.tt @include_\n",
+	})
+
+	a := filepath.Join(dir, "a.tt")
+	b := filepath.Join(dir, "b.tt")
+	err := parser.Parse(a)
+	if err == nil {
+		t.Fatal("include cycle but error is not returned")
+	}
+
+	templateErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("Expected template error but got %v", err)
+	}
+
+	expected := "include cycle: " + a + " -> " + b + " -> " + a
+	if templateErr.Message != expected {
+		t.Errorf("Expected '%s' but got '%s'", expected, templateErr.Message)
+	}
+
+	if templateErr.File != b || templateErr.Line != 2 {
+		t.Errorf("Expected error at %s:2 but got %s", b, templateErr.Position())
+	}
+
+	if len(templateErr.Includes) != 1 || templateErr.Includes[0].File != a {
+		t.Errorf("unexpected include stack %v", templateErr.Includes)
+	}
+}
+
+func TestParseIncludeOnce(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	writeTemplates(t, dir, map[string]string{
+		"main.tt": `@include:once common.tt @include_
+@include:once
+common.tt
+@include_
+@include sub/sub.tt @include_
+`,
+		"common.tt":     "@def $one\n1\n@def_\n@dir once\n@file f???.c $main(0) @file_\n@dir_\n",
+		"sub/sub.tt":    "@include:once ../common.tt @include_\n@include local.tt @include_\n",
+		"sub/local.tt":  "@dir test\n@file one.c $main($one) @file_\n@dir_\n",
+		"local.tt":      "@def $one\n2\n@def_\n",
+		"sub/common.tt": "@unknown\n@unknown_\n",
+	})
+
+	if err := parser.Parse(filepath.Join(dir, "main.tt")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "once", "f001.c")); !os.IsNotExist(err) {
+		t.Error("file included by '@include:once' is included twice")
+	}
+
+	got := readGeneratedFile(t, filepath.Join(dir, "test", "one.c"))
+	if got != "int main(void) { return 1; }\n" {
+		t.Errorf("file should be included relative to including file(got=%s)", got)
+	}
+}
+
+func TestParseIncludeSearchOrder(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	writeTemplates(t, dir, map[string]string{
+		"main.tt":     "@include a.tt @include_\n@include b.tt @include_\n@include c.tt @include_\n",
+		"a.tt":        "@def $a\nmain\n@def_\n",
+		"first/a.tt":  "@def $a\nfirst\n@def_\n",
+		"first/b.tt":  "@def $b\nfirst\n@def_\n",
+		"second/b.tt": "@def $b\nsecond\n@def_\n",
+		"second/c.tt": "@def $c\nsecond\n@def_\n",
+	})
+
+	var trace bytes.Buffer
+	parser.IncludeTrace = &trace
+	parser.IncludePaths = []string{filepath.Join(dir, "first"), filepath.Join(dir, "second")}
+
+	main := filepath.Join(dir, "main.tt")
+	if err := parser.Parse(main); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"$a": "main", "$b": "first", "$c": "second"}
+	for name, body := range expected {
+		if m := parser.environment()[name]; m == nil || m.Body != body {
+			t.Errorf("Expected %s in '%s' is included", name, body)
+		}
+	}
+
+	expectedTrace := main + ":1: @include a.tt => " + filepath.Join(dir, "a.tt") + "\n" +
+		main + ":2: @include b.tt => " + filepath.Join(dir, "first", "b.tt") + "\n" +
+		main + ":3: @include c.tt => " + filepath.Join(dir, "second", "c.tt") + "\n"
+	if trace.String() != expectedTrace {
+		t.Errorf("Expected trace %q but got %q", expectedTrace, trace.String())
+	}
+}
+
+func TestParseConcurrently(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const parsers = 2
+	dirs := make([]string, parsers)
+	errs := make(chan error, parsers)
+	for i := 0; i < parsers; i++ {
+		parser, dir := testParser(t)
+		defer os.RemoveAll(dir)
+		dirs[i] = dir
+
+		content := "@dir test\n"
+		for j := 0; j < 20; j++ {
+			content += "@file f???.c $main(" + strconv.Itoa(i) + ") @file_\n"
+		}
+		content += "@dir_\n"
+		writeTemplates(t, dir, map[string]string{"test.tt": content})
+
+		go func(parser *Parser, template string) {
+			errs <- parser.Parse(template)
+		}(parser, filepath.Join(dir, "test.tt"))
+	}
+
+	for i := 0; i < parsers; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, dir := range dirs {
+		expected := "int main(void) { return " + strconv.Itoa(i) + "; }\n"
+		for j := 0; j < 20; j++ {
+			file := filepath.Join(dir, "test", fmt.Sprintf("f%03d.c", j))
+			if got := readGeneratedFile(t, file); got != expected {
+				t.Errorf("%s: Expected '%s' but got '%s'", file, expected, got)
+			}
+		}
+	}
+
+	if wd, err := os.Getwd(); err != nil || wd != pwd {
+		t.Errorf("working directory is changed(got=%s)", wd)
+	}
+}
+
+func TestParseDirSectionRegenerate(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	stale := filepath.Join(dir, "test", "stale.c")
+	writeTemplates(t, dir, map[string]string{"test/stale.c": ""})
+
+	template := `@dir test
+@file a.c $main(0) @file_
+@dir_
+@dir test
+@file b.c $main(1) @file_
+@dir_
+`
+	if err := parseText(parser, template); err == nil {
+		t.Fatal("second @dir of the same name but error is not returned")
+	}
+
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("files of previous run in output directory are not removed")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "test", "a.c")); err != nil {
+		t.Error("files of the first @dir are removed by the second @dir")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "test", "b.c")); !os.IsNotExist(err) {
+		t.Error("file of the duplicated @dir is generated")
+	}
+}
+
+func TestParseDirSectionDuplicated(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	writeTemplates(t, dir, map[string]string{
+		"a.tt": "@dir test\n@file a.c $main(0) @file_\n@dir_\n",
+		"b.tt": "\n@dir test/\n@file b.c $main(1) @file_\n@dir_\n",
+	})
+
+	a := filepath.Join(dir, "a.tt")
+	if err := parser.Parse(a); err != nil {
+		t.Fatal(err)
+	}
+
+	err := parser.Parse(filepath.Join(dir, "b.tt"))
+	templateErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("duplicated @dir but template error is not returned(got=%v)", err)
+	}
+
+	expected := "duplicated @dir 'test/'(previous @dir is at " + a + ":1)"
+	if templateErr.Line != 2 || templateErr.Message != expected {
+		t.Errorf("Expected '%s' at line 2 but got '%s' at line %d", expected, templateErr.Message, templateErr.Line)
+	}
+
+	files, err := manifest.Read(filepath.Join(dir, "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := files.Lookup("a.c"); !ok || len(files.Entries) != 1 {
+		t.Errorf("manifest of the first @dir is overwritten(got=%v)", files.Entries)
+	}
+}
+
+func TestParseDirSectionOutsideOutputDirectory(t *testing.T) {
+	base, err := ioutil.TempDir("", "testgon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	precious := filepath.Join(base, "precious.txt")
+	writeTemplates(t, base, map[string]string{"precious.txt": "", "suite/keep.c": ""})
+
+	parser := NewParser(filepath.Join(base, "suite"), nil)
+	for _, name := range []string{".", "..", "../suite", "a/../..", precious} {
+		template := "@dir " + name + "\n@dir_\n"
+		if err := parseText(parser, template); err == nil {
+			t.Errorf("@dir '%s' but error is not returned", name)
+		}
+	}
+
+	for _, path := range []string{precious, filepath.Join(base, "suite", "keep.c")} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("'%s' is removed", path)
+		}
+	}
+}
@@ -1,15 +1,20 @@
 package template
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+
+	"github.com/syohex/testgon/manifest"
+	"github.com/syohex/testgon/template/macro"
 )
 
-type sectionFunc func(parser *Parser, arg string, content string) error
+type sectionFunc func(parser *Parser, section *Section) error
 
 var dispatchTable map[string]sectionFunc
 
@@ -19,33 +24,163 @@ func init() {
 	dispatchTable["dir"] = parseDirSection
 	dispatchTable["include"] = parseIncludeSection
 	dispatchTable["comment"] = parseCommentSection
+	dispatchTable["if"] = parseIfSection
 }
 
-func parseDefSection(parser *Parser, arg string, content string) error {
-	return nil
+// defArgRegexp matches argument of '@def' section. (ex $name($a, $b))
+// $1='macro name', $2='dummy arguments'
+var defArgRegexp = regexp.MustCompile(`^\s*(\$[a-zA-Z0-9]+)\s*(?:\((.*)\))?\s*$`)
+
+// dummyArgRegexp matches one dummy argument. (ex $a, $a=10, $rest...)
+// $1='name', $2='...' if variadic, $3='default value'
+var dummyArgRegexp = regexp.MustCompile(`^(\$[a-zA-Z0-9]+)(?:(\.\.\.)|\s*=\s*(.*))?$`)
+
+type dummyArgs struct {
+	names    []string
+	defaults map[string]string
+	variadic bool
 }
 
-var emptyLineRegexp = regexp.MustCompile(`^\s*$`)
-var commentStart = regexp.MustCompile(`^@comment`)
-var commentEnd = regexp.MustCompile(`^@comment_`)
+func parseDummyArgs(name string, argsStr string) (*dummyArgs, error) {
+	parsed := &dummyArgs{}
+	if strings.TrimSpace(argsStr) == "" {
+		return parsed, nil
+	}
+
+	args := macro.SplitList(argsStr)
+	seen := make(map[string]bool)
+	for i, arg := range args {
+		arg = strings.TrimSpace(arg)
+		matched := dummyArgRegexp.FindStringSubmatch(arg)
+		if matched == nil {
+			return nil, fmt.Errorf("[%s]invalid dummy argument '%s'", name, arg)
+		}
+
+		dummy := matched[1]
+		if seen[dummy] {
+			return nil, fmt.Errorf("[%s]duplicated dummy argument '%s'", name, dummy)
+		}
+		seen[dummy] = true
 
-func skipCommentSection(scanner *bufio.Scanner) error {
-	for scanner.Scan() {
-		line := scanner.Text()
-		if commentEnd.MatchString(line) {
-			break
+		switch {
+		case matched[2] != "":
+			if i != len(args)-1 {
+				return nil, fmt.Errorf("[%s]variadic argument '%s' should be last", name, dummy)
+			}
+			parsed.variadic = true
+		case strings.Contains(arg, "="):
+			if parsed.defaults == nil {
+				parsed.defaults = make(map[string]string)
+			}
+			parsed.defaults[dummy] = strings.TrimSpace(matched[3])
+		case len(parsed.defaults) > 0:
+			return nil, fmt.Errorf("[%s]'%s' should have default value because it follows default argument",
+				name, dummy)
 		}
+
+		parsed.names = append(parsed.names, dummy)
 	}
 
-	if err := scanner.Err(); err != nil {
-		return err
+	return parsed, nil
+}
+
+func sameMacro(a *macro.Macro, b *macro.Macro) bool {
+	if a.Body != b.Body || a.Variadic != b.Variadic ||
+		len(a.DummyArgs) != len(b.DummyArgs) || len(a.Defaults) != len(b.Defaults) {
+		return false
 	}
 
+	for i := range a.DummyArgs {
+		if a.DummyArgs[i] != b.DummyArgs[i] {
+			return false
+		}
+	}
+
+	for name, value := range a.Defaults {
+		if other, ok := b.Defaults[name]; !ok || other != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (parser *Parser) defineMacro(m *macro.Macro) error {
+	if _, ok := parser.predefined[m.Name]; ok {
+		return fmt.Errorf("can't redefine predefined macro '%s'", m.Name)
+	}
+
+	env := parser.environment()
+	if old, ok := env[m.Name]; ok && !sameMacro(old, m) {
+		parser.warn("'%s' is redefined(previous definition is in %s)",
+			m.Name, parser.definedIn[m.Name])
+	}
+
+	env[m.Name] = m
+	parser.definedIn[m.Name] = parser.currentFile
 	return nil
 }
 
-var macroCallRegexp = regexp.MustCompile(`^([^(]+)\((.*)\)$`)
-var macroArgRegexp = regexp.MustCompile(`(?:(?:\[([^]])+\])|(\w+))\s*,?`)
+// defBody returns content of '@def' section without lines of '@comment'
+// sections in it. Other nested sections are errors.
+func (parser *Parser) defBody(section *Section) (string, error) {
+	if len(section.Children) == 0 {
+		return section.Content, nil
+	}
+
+	for _, child := range section.Children {
+		if child.Name != "comment" {
+			return "", parser.errorAt(child.Line, 1,
+				fmt.Errorf("unknown section '@%s' in @def section", child.Name))
+		}
+	}
+
+	lines := strings.Split(section.Content, "\n")
+	body := make([]string, 0, len(lines))
+	for i, line := range lines {
+		lineNumber := section.Line + 1 + i
+		inComment := false
+		for _, child := range section.Children {
+			if child.Line <= lineNumber && lineNumber <= child.EndLine {
+				inComment = true
+			}
+		}
+
+		if !inComment {
+			body = append(body, line)
+		}
+	}
+
+	return strings.Join(body, "\n"), nil
+}
+
+func parseDefSection(parser *Parser, section *Section) error {
+	matched := defArgRegexp.FindStringSubmatch(section.Arg)
+	if matched == nil {
+		return fmt.Errorf("Invalid macro definition: '%s'", strings.TrimSpace(section.Arg))
+	}
+
+	name := matched[1]
+	args, err := parseDummyArgs(name, matched[2])
+	if err != nil {
+		return err
+	}
+
+	body, err := parser.defBody(section)
+	if err != nil {
+		return err
+	}
+
+	m := &macro.Macro{
+		Name:      name,
+		Body:      strings.Trim(body, "\r\n"),
+		DummyArgs: args.names,
+		Defaults:  args.defaults,
+		Variadic:  args.variadic,
+	}
+
+	return parser.defineMacro(m)
+}
 
 type macroCall struct {
 	name      string
@@ -53,74 +188,477 @@ type macroCall struct {
 }
 
 func parseMacroString(macroStr string) (*macroCall, error) {
-	matched := macroCallRegexp.FindStringSubmatch(macroStr)
-	if matched == nil {
-		return nil, fmt.Errorf("Invalid macro: '%s'", macroStr)
+	name, arguments, err := macro.ParseCall(macroStr)
+	if err != nil {
+		return nil, err
 	}
 
-	name := matched[1]
-	arg := matched[2]
+	call := &macroCall{
+		name:      name,
+		arguments: arguments,
+	}
 
-	arguments := make([]string, 0)
+	return call, nil
+}
+
+// fileArgRegexp matches body of '@file' section, that is text between
+// '@file' and '@file_'. (ex :int fn???.c $main(0) @ok 2 @ok_)
+// $1=category, $2=filename, $3=macro(args), $4=oknum
+var fileArgRegexp = regexp.MustCompile(`(?s)^(?::(\w+))?\s+(\S+)\s+(\$[^(\s]+\(.*\))(?:\s+@ok\s+(\d+)\s+@ok_)?\s*$`)
+
+// Category of generated test. Files of category which is same as
+// Parser.Skip are not generated.
+type Category int
+
+const (
+	UNTAGGED Category = iota
+	INT_TEST
+	FLOAT_TEST
+)
+
+var categoryNames = map[string]Category{
+	"int":   INT_TEST,
+	"float": FLOAT_TEST,
+}
+
+func parseCategory(name string) (Category, error) {
+	category, ok := categoryNames[name]
+	if !ok {
+		return UNTAGGED, fmt.Errorf("Unknown test category '%s'(should be 'int' or 'float')", name)
+	}
+
+	return category, nil
+}
+
+// defaultOkCount is expected count of OK markers if '@ok' is omitted
+const defaultOkCount = 1
 
-	matcheds := macroArgRegexp.FindAllStringSubmatch(arg, 0)
-	for _, matched := range matcheds {
-		if matched[1] != "" { // argument in brackets
-			arg := strings.Trim(matched[1], " \t\r\n")
-			arguments = append(arguments, arg)
-		} else if matched[2] != "" {
-			arg := strings.Trim(matched[2], " \t\r\n")
-			arguments = append(arguments, arg)
+func expandMacroCall(parser *Parser, macroStr string, line int) (string, error) {
+	call, err := parseMacroString(macroStr)
+	if err != nil {
+		return "", err
+	}
+
+	env := parser.environment()
+	m, ok := env[call.name]
+	if !ok {
+		return "", fmt.Errorf("'%s' is not defined macro", call.name)
+	}
+
+	expander := &macro.Expander{
+		Env:      env,
+		MaxDepth: parser.MaxMacroDepth,
+		File:     parser.currentFile,
+		Line:     line,
+	}
+
+	return expander.Expand(m, call.arguments)
+}
+
+// expandText expands macros in text which is not a macro call. name is
+// used in error messages.
+func expandText(parser *Parser, name string, text string, line int) (string, error) {
+	expander := &macro.Expander{
+		Env:      parser.environment(),
+		MaxDepth: parser.MaxMacroDepth,
+		File:     parser.currentFile,
+		Line:     line,
+	}
+
+	return expander.Expand(&macro.Macro{Name: name, Body: text}, nil)
+}
+
+var placeholderRegexp = regexp.MustCompile(`\?+`)
+
+// expandFilename replaces each run of '?' in name with zero-padded filename
+// index of the same width. (ex fn???.c => fn007.c) The index is incremented
+// only if name has placeholders.
+func (parser *Parser) expandFilename(name string) (string, error) {
+	if !placeholderRegexp.MatchString(name) {
+		return name, nil
+	}
+
+	index := parser.filenameIndex
+	var err error
+	expanded := placeholderRegexp.ReplaceAllStringFunc(name, func(placeholder string) string {
+		width := len(placeholder)
+		number := fmt.Sprintf("%0*d", width, index)
+		if len(number) > width && err == nil {
+			err = fmt.Errorf("filename index %d overflows placeholder of '%s'", index, name)
 		}
+		return number
+	})
+	if err != nil {
+		return "", err
 	}
 
-	macro := &macroCall{
-		name:      name,
-		arguments: arguments,
+	parser.filenameIndex++
+	return expanded, nil
+}
+
+// writeGeneratedFile writes content in OutputEncoding
+func (parser *Parser) writeGeneratedFile(path string, content string) error {
+	if !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+
+	encoded, err := encodeText(content, parser.OutputEncoding)
+	if err != nil {
+		return err
 	}
 
-	return macro, nil
+	return ioutil.WriteFile(path, encoded, 0644)
 }
 
-// TODO should test this regexp
-var fileSectionRegexp = regexp.MustCompile(`(?sm)@file\s+(\S+)\s+(\$[^(]+\(.*\))\s+(?:@ok\s+(\d+)\s+@ok_\s+)?\@file_`)
+func submatches(s string, loc []int) []string {
+	matched := make([]string, len(loc)/2)
+	for i := range matched {
+		if loc[2*i] >= 0 {
+			matched[i] = s[loc[2*i]:loc[2*i+1]]
+		}
+	}
+
+	return matched
+}
+
+// fileSection generates file of '@file' section. If autoWidth is not 0,
+// placeholder of the width is added to filename which has no placeholders so
+// that files generated by '@matrix' have distinct names.
+func (parser *Parser) fileSection(
+	dirPath string,
+	dirCategory Category,
+	section *Section,
+	autoWidth int,
+	files *manifest.Manifest,
+) error {
+	body := section.body()
+	loc := fileArgRegexp.FindStringSubmatchIndex(body)
+	if loc == nil {
+		return parser.errorAt(section.Line, 1,
+			errors.New("Invalid @file section(should be '@file[:CATEGORY] NAME $MACRO(ARGS) [@ok N @ok_] @file_')"))
+	}
+
+	// $1=category, $2=filename, $3=macro(args), $4=oknum
+	matched := submatches(body, loc)
+	name := matched[2]
+	if autoWidth != 0 && !placeholderRegexp.MatchString(name) {
+		ext := filepath.Ext(name)
+		name = strings.TrimSuffix(name, ext) + strings.Repeat("?", autoWidth) + ext
+	}
+
+	filename, err := parser.expandFilename(name)
+	if err != nil {
+		line, column := section.position(loc[4])
+		return parser.errorAt(line, column, err)
+	}
 
-func processDirSection(content string) error {
-	sr := strings.NewReader(content)
-	scanner := bufio.NewScanner(sr)
+	path := filepath.Join(dirPath, filename)
+	if previous, ok := parser.files[path]; ok {
+		line, column := section.position(loc[4])
+		return parser.errorAt(line, column, fmt.Errorf("duplicated file '%s'(previous @file is at %s:%d)",
+			filename, previous.File, previous.Line))
+	}
+	parser.files[path] = Position{File: parser.currentFile, Line: section.Line}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if emptyLineRegexp.MatchString(line) {
-			continue
+	category := dirCategory
+	if matched[1] != "" {
+		if category, err = parseCategory(matched[1]); err != nil {
+			line, column := section.position(loc[2])
+			return parser.errorAt(line, column, err)
 		}
+	}
+
+	if category != UNTAGGED && category == parser.Skip {
+		parser.skipped++
+		return nil
+	}
+
+	line, column := section.position(loc[6])
+	expanded, err := expandMacroCall(parser, matched[3], line)
+	if err != nil {
+		e := parser.errorAt(line, column, err)
+		e.Message = filename + ": " + e.Message
+		return e
+	}
+
+	if err := parser.writeGeneratedFile(path, expanded); err != nil {
+		e := parser.errorAt(line, column, err)
+		e.Message = filename + ": " + e.Message
+		return e
+	}
+
+	ok := defaultOkCount
+	if matched[4] != "" {
+		if ok, err = strconv.Atoi(matched[4]); err != nil {
+			return err
+		}
+	}
+	files.Add(filename, ok)
 
-		if matched := fileSectionRegexp.FindStringSubmatch(line); matched != nil {
-			// $1=filename, $2=macro(args), $3=oknum
-			_, err := parseMacroString(matched[2]) // XXX
-			if err != nil {
-				return err
+	return nil
+}
+
+// matrixVarRegexp matches one loop variable of '@matrix' section. Values
+// are a macro or a bracketed list. (ex $t=$INTTYPES, $v=[0, 1])
+// $1='name', $2='values'
+var matrixVarRegexp = regexp.MustCompile(`(\$[a-zA-Z0-9]+)\s*=\s*(\[[^\]]*\]|\$[a-zA-Z0-9]+)`)
+
+type matrixVar struct {
+	name   string
+	values []string
+}
+
+func (parser *Parser) parseMatrixVars(arg string, line int) ([]*matrixVar, error) {
+	locs := matrixVarRegexp.FindAllStringSubmatchIndex(arg, -1)
+	if len(locs) == 0 || strings.TrimSpace(matrixVarRegexp.ReplaceAllString(arg, "")) != "" {
+		return nil, fmt.Errorf("Invalid @matrix argument: '%s'", strings.TrimSpace(arg))
+	}
+
+	vars := make([]*matrixVar, 0, len(locs))
+	seen := make(map[string]bool)
+	for _, loc := range locs {
+		matched := submatches(arg, loc)
+		name, list := matched[1], matched[2]
+		if seen[name] {
+			return nil, fmt.Errorf("duplicated @matrix variable '%s'", name)
+		}
+		seen[name] = true
+
+		if _, ok := parser.predefined[name]; ok {
+			return nil, fmt.Errorf("predefined macro '%s' can't be @matrix variable", name)
+		}
+
+		if strings.HasPrefix(list, "[") {
+			list = list[1 : len(list)-1]
+		}
+
+		expanded, err := expandText(parser, "@matrix", list, line)
+		if err != nil {
+			return nil, err
+		}
+
+		values := macro.SplitList(expanded)
+		if len(values) == 0 {
+			return nil, fmt.Errorf("@matrix variable '%s' has no values", name)
+		}
+
+		vars = append(vars, &matrixVar{name: name, values: values})
+	}
+
+	return vars, nil
+}
+
+// minMatrixPlaceholderWidth is width of placeholder added to filenames in
+// '@matrix' sections if indexes are small. (ex conv???.c)
+const minMatrixPlaceholderWidth = 3
+
+// matrixPlaceholderWidth returns width of placeholder which can hold indexes
+// up to lastIndex
+func matrixPlaceholderWidth(lastIndex int) int {
+	width := len(strconv.Itoa(lastIndex))
+	if width < minMatrixPlaceholderWidth {
+		return minMatrixPlaceholderWidth
+	}
+
+	return width
+}
+
+// countFileSections returns upper bound of number of files generated by one
+// pass of sections. Both branches of '@if' are counted. Files in nested
+// '@matrix' are counted once if its values depend on outer variables.
+func (parser *Parser) countFileSections(sections []*Section) int {
+	count := 0
+	for _, section := range sections {
+		switch section.Name {
+		case "file":
+			count++
+		case "matrix":
+			combinations := 1
+			if vars, err := parser.parseMatrixVars(section.Arg, section.Line); err == nil {
+				combinations = matrixCombinations(vars)
 			}
+			count += combinations * parser.countFileSections(section.Children)
+		default:
+			count += parser.countFileSections(section.Children)
+		}
+	}
+
+	return count
+}
 
-		} else if commentStart.MatchString(line) {
-			if commentEnd.MatchString(line) {
-				continue
+func matrixCombinations(vars []*matrixVar) int {
+	combinations := 1
+	for _, v := range vars {
+		combinations *= len(v.values)
+	}
+
+	return combinations
+}
+
+// matrixSection generates files of sections in '@matrix' section for each
+// combination of values of its variables. The last variable changes
+// fastest.
+func (parser *Parser) matrixSection(
+	dirPath string,
+	dirCategory Category,
+	section *Section,
+	files *manifest.Manifest,
+) error {
+	vars, err := parser.parseMatrixVars(section.Arg, section.Line)
+	if err != nil {
+		return parser.errorAt(section.Line, 1, err)
+	}
+
+	last := parser.filenameIndex + matrixCombinations(vars)*parser.countFileSections(section.Children) - 1
+	width := matrixPlaceholderWidth(last)
+
+	env := parser.environment()
+	for _, v := range vars {
+		if old, ok := env[v.name]; ok {
+			defer func(name string) { env[name] = old }(v.name)
+		} else {
+			defer delete(env, v.name)
+		}
+	}
+
+	indexes := make([]int, len(vars))
+	for {
+		for i, v := range vars {
+			env[v.name] = &macro.Macro{Name: v.name, Body: v.values[indexes[i]]}
+		}
+
+		if err := processDirSection(parser, dirPath, dirCategory, section.Children, width, files); err != nil {
+			return err
+		}
+
+		i := len(vars) - 1
+		for ; i >= 0; i-- {
+			indexes[i]++
+			if indexes[i] < len(vars[i].values) {
+				break
 			}
+			indexes[i] = 0
+		}
+
+		if i < 0 {
+			return nil
+		}
+	}
+}
 
-			if err := skipCommentSection(scanner); err != nil {
-				return err
+// evalCondition evaluates condition of '@if' section. Macros in condition
+// are expanded before evaluation. (ex '$LONG == 64', '$LANG == "c"')
+func evalCondition(parser *Parser, condition string, line int) (bool, error) {
+	expanded, err := expandText(parser, "@if", condition, line)
+	if err != nil {
+		return false, err
+	}
+
+	value, err := macro.EvalExpression(expanded)
+	if err != nil {
+		return false, err
+	}
+
+	return value.Sign() != 0, nil
+}
+
+// selectBranch evaluates condition of '@if' section and returns sections in
+// the selected branch
+func (parser *Parser) selectBranch(section *Section) ([]*Section, error) {
+	condition := strings.TrimSpace(section.Arg)
+	taken, err := evalCondition(parser, condition, section.Line)
+	if err != nil {
+		_, column := section.position(strings.Index(section.Arg, condition))
+		return nil, parser.errorAt(section.Line, column, err)
+	}
+
+	branch := make([]*Section, 0, len(section.Children))
+	for _, child := range section.Children {
+		inThen := section.ElseLine == 0 || child.Line < section.ElseLine
+		if inThen == taken {
+			branch = append(branch, child)
+		}
+	}
+
+	return branch, nil
+}
+
+// processDirSection generates files of sections in '@dir' section. '@if'
+// sections are resolved and '@comment' sections are ignored. Other sections
+// are errors. autoWidth is width of placeholder added to filenames in
+// '@matrix' sections, or 0 out of them. (see fileSection)
+func processDirSection(
+	parser *Parser,
+	dirPath string,
+	dirCategory Category,
+	sections []*Section,
+	autoWidth int,
+	files *manifest.Manifest,
+) error {
+	for _, section := range sections {
+		var err error
+		switch section.Name {
+		case "file":
+			err = parser.fileSection(dirPath, dirCategory, section, autoWidth, files)
+		case "matrix":
+			err = parser.matrixSection(dirPath, dirCategory, section, files)
+		case "if":
+			var branch []*Section
+			if branch, err = parser.selectBranch(section); err == nil {
+				err = processDirSection(parser, dirPath, dirCategory, branch, autoWidth, files)
 			}
+		case "comment":
+			// Do nothing
+		default:
+			err = parser.errorAt(section.Line, 1,
+				fmt.Errorf("unknown section '@%s' in @dir section", section.Name))
+		}
+
+		if err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func parseDirSection(parser *Parser, arg string, content string) error {
-	dir := strings.Trim(arg, " \t\n\r")
+// parseDirSection handles '@dir NAME [CATEGORY]'. CATEGORY is default
+// category of files in the section. Files are written under NAME in output
+// directory without changing working directory, so parsers can run
+// concurrently. Files left in NAME by previous runs are removed. NAME can't
+// be used by other '@dir' sections in the same run because manifest of NAME
+// is written by the section, and they would remove files of the section.
+func parseDirSection(parser *Parser, section *Section) error {
+	fields := strings.Fields(section.Arg)
+	if len(fields) == 0 || len(fields) > 2 {
+		return fmt.Errorf("Invalid @dir argument: '%s'", strings.TrimSpace(section.Arg))
+	}
+
+	dir := fields[0]
+	category := UNTAGGED
+	if len(fields) == 2 {
+		var err error
+		if category, err = parseCategory(fields[1]); err != nil {
+			return err
+		}
+	}
+
+	if filepath.IsAbs(dir) {
+		return fmt.Errorf("@dir '%s' should be relative to output directory", dir)
+	}
 
 	dirPath := filepath.Join(parser.outputDirectory, dir)
-	if _, err := os.Stat(dirPath); os.IsExist(err) {
+	rel, err := filepath.Rel(parser.outputDirectory, dirPath)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("@dir '%s' should be under output directory", dir)
+	}
+
+	if previous, ok := parser.dirs[dirPath]; ok {
+		return fmt.Errorf("duplicated @dir '%s'(previous @dir is at %s:%d)", dir, previous.File, previous.Line)
+	}
+	parser.dirs[dirPath] = Position{File: parser.currentFile, Line: section.Line}
+
+	if _, err := os.Stat(dirPath); err == nil {
 		if err := os.RemoveAll(dirPath); err != nil {
 			return err
 		}
@@ -130,49 +668,138 @@ func parseDirSection(parser *Parser, arg string, content string) error {
 		return err
 	}
 
-	pwd, err := os.Getwd()
-	if err != nil {
+	files := manifest.New()
+	if err := processDirSection(parser, dirPath, category, section.Children, 0, files); err != nil {
 		return err
 	}
 
-	if err := os.Chdir(dirPath); err != nil {
-		return err
+	return files.Write(dirPath)
+}
+
+// resolveInclude searches path in directory of including file at first,
+// and then in IncludePaths in order. (see Parser)
+func (parser *Parser) resolveInclude(path string) (string, error) {
+	if filepath.IsAbs(path) {
+		if _, err := os.Stat(path); err != nil {
+			return "", fmt.Errorf("'%s' is not found", path)
+		}
+		return path, nil
 	}
-	defer os.Chdir(pwd)
 
-	return nil
+	dirs := make([]string, 0, len(parser.IncludePaths)+1)
+	if parser.currentFile != "" {
+		dirs = append(dirs, filepath.Dir(parser.currentFile))
+	}
+	dirs = append(dirs, parser.IncludePaths...)
+
+	for _, dir := range dirs {
+		candidate := filepath.Join(dir, path)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("'%s' is not found", path)
+}
+
+func absPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+
+	return abs
 }
 
-func parseIncludeSection(parser *Parser, arg string, content string) error {
-	path := strings.Trim(content, " \t\n\r")
+// checkIncludeCycle returns error if file is being parsed. Error message has
+// include chain. (ex include cycle: a.tt -> b.tt -> a.tt)
+func (parser *Parser) checkIncludeCycle(file string) error {
+	chain := make([]string, 0, len(parser.includes)+2)
+	for _, include := range parser.includes {
+		chain = append(chain, include.File)
+	}
+	chain = append(chain, parser.currentFile)
 
-	var includedFile string
-	for _, includePath := range parser.IncludePaths {
-		copyed := path
-		if !filepath.IsAbs(path) {
-			copyed = filepath.Join(includePath, copyed)
+	target := absPath(file)
+	for i, includer := range chain {
+		if includer != "" && absPath(includer) == target {
+			return fmt.Errorf("include cycle: %s", strings.Join(append(chain[i:], file), " -> "))
 		}
+	}
+
+	return nil
+}
 
-		if _, err := os.Stat(copyed); !os.IsNotExist(err) {
-			includedFile = copyed
-			break
+// parseIncludeSection handles '@include' section. Path of included file is
+// its content, or its argument if it is one line section.
+// (ex @include common.tt @include_) '@include:once' doesn't include file
+// which is already included in the template.
+func parseIncludeSection(parser *Parser, section *Section) error {
+	arg := section.Arg
+	once := false
+	if strings.HasPrefix(arg, ":") {
+		fields := strings.Fields(arg[1:])
+		if len(fields) == 0 || fields[0] != "once" {
+			return fmt.Errorf("Unknown @include option: '%s'", strings.TrimSpace(arg))
 		}
+
+		once = true
+		arg = strings.TrimSpace(arg[1:])[len("once"):]
+	}
+
+	path := strings.Trim(section.Content, " \t\n\r")
+	if path == "" {
+		path = strings.TrimSpace(arg)
 	}
 
-	if includedFile == "" {
-		return fmt.Errorf("'%s' is not found", path)
+	includedFile, err := parser.resolveInclude(path)
+	if err != nil {
+		return err
+	}
+
+	if parser.IncludeTrace != nil {
+		fmt.Fprintf(parser.IncludeTrace, "%s:%d: @include %s => %s\n",
+			parser.currentFile, section.Line, path, includedFile)
 	}
 
-	file, err := os.Open(includedFile)
+	if err := parser.checkIncludeCycle(includedFile); err != nil {
+		return err
+	}
+
+	if once && parser.included[absPath(includedFile)] {
+		return nil
+	}
+	parser.included[absPath(includedFile)] = true
+
+	includer := parser.currentFile
+	parser.includes = append(parser.includes, Position{File: includer, Line: section.Line})
+	parser.currentFile = includedFile
+	defer func() {
+		parser.currentFile = includer
+		parser.includes = parser.includes[:len(parser.includes)-1]
+	}()
+
+	doc, err := parser.loadDocument(includedFile)
+	if err != nil {
+		return parser.documentError(err)
+	}
+
+	return parser.parseDocument(doc)
+}
+
+// parseIfSection handles '@if EXPR' section in top level. Sections in the
+// selected branch are parsed like sections in template. '@if' sections in
+// '@dir' sections are resolved by processDirSection.
+func parseIfSection(parser *Parser, section *Section) error {
+	branch, err := parser.selectBranch(section)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	return parser.parseTemplate(file)
+	return parser.parseSections(branch)
 }
 
-func parseCommentSection(parser *Parser, arg string, content string) error {
+func parseCommentSection(parser *Parser, section *Section) error {
 	// Do nothing
 	return nil
 }
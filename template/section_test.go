@@ -1,12 +1,763 @@
 package template
 
 import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/syohex/testgon/manifest"
+	"github.com/syohex/testgon/template/macro"
 )
 
-func TestFileSectionRegexp(t *testing.T) {
-	input := `@file >>fn???_extern.c $macro1() @file_`
-	if !fileSectionRegexp.MatchString(input) {
-		t.Errorf("Can't match to '%s'", input)
+func TestFileArgRegexp(t *testing.T) {
+	valids := []string{" >>fn???_extern.c $macro1() ", ":int a.c $f(1, (2)) @ok 2 @ok_ ", " a.c\n  $f(\n1)"}
+	for _, input := range valids {
+		if !fileArgRegexp.MatchString(input) {
+			t.Errorf("Can't match to %q", input)
+		}
+	}
+
+	invalids := []string{" a.c main(0) ", " a.c $main(0) @ok 2 ", " a.c ", " a.c $main(0) b.c"}
+	for _, input := range invalids {
+		if fileArgRegexp.MatchString(input) {
+			t.Errorf("Should not match to %q", input)
+		}
+	}
+}
+
+func testParser(t *testing.T) (*Parser, string) {
+	dir, err := ioutil.TempDir("", "testgon")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := make(map[string]*macro.Macro)
+	env["$main"] = &macro.Macro{
+		Name:      "$main",
+		Body:      "int main(void) { return $ret; }",
+		DummyArgs: []string{"$ret"},
+	}
+
+	return NewParser(dir, env), dir
+}
+
+// readSection reads text whose first line is line and returns its first
+// section
+func readSection(t *testing.T, parser *Parser, text string, line int) *Section {
+	doc, err := readDocument(parser.currentFile, strings.NewReader(text), line)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parser.document = doc
+	return doc.Sections[0]
+}
+
+// dirChildren returns sections in '@dir' section which starts at line
+func dirChildren(t *testing.T, parser *Parser, content string, line int) []*Section {
+	return readSection(t, parser, "@dir test\n"+content+"\n@dir_\n", line).Children
+}
+
+func readGeneratedFile(t *testing.T, path string) string {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(bytes)
+}
+
+func TestParseMacroString(t *testing.T) {
+	call, err := parseMacroString(`$check(int, [1, 2], -1)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if call.name != "$check" {
+		t.Errorf("Expected '$check' but got '%s'", call.name)
+	}
+
+	expected := []string{"int", "1, 2", "-1"}
+	if len(call.arguments) != len(expected) {
+		t.Fatalf("Expected %v but got %v", expected, call.arguments)
+	}
+
+	for i, arg := range expected {
+		if call.arguments[i] != arg {
+			t.Errorf("Expected '%s' but got '%s'", arg, call.arguments[i])
+		}
+	}
+}
+
+func TestProcessDirSection(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	content := `
+@file fn001.c $main(0) @file_
+@comment
+@file ignored.c $main(1) @file_
+@comment_
+@file fn002.c
+  $main(1)
+@file_
+`
+	sections := dirChildren(t, parser, content, 1)
+	if err := processDirSection(parser, dir, UNTAGGED, sections, 0, manifest.New()); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readGeneratedFile(t, filepath.Join(dir, "fn001.c"))
+	if got != "int main(void) { return 0; }\n" {
+		t.Errorf("unexpected generated file(got=%s)", got)
+	}
+
+	got = readGeneratedFile(t, filepath.Join(dir, "fn002.c"))
+	if got != "int main(void) { return 1; }\n" {
+		t.Errorf("unexpected generated file from multiline section(got=%s)", got)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "ignored.c")); err == nil {
+		t.Error("file in comment section is generated")
+	}
+}
+
+func TestProcessDirSectionUndefinedMacro(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	content := `@file fn001.c $undefined() @file_`
+	sections := dirChildren(t, parser, content, 1)
+	if err := processDirSection(parser, dir, UNTAGGED, sections, 0, manifest.New()); err == nil {
+		t.Error("undefined macro is called but error is not returned")
+	}
+}
+
+func TestProcessDirSectionInvalidSections(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	parser.currentFile = "test.tt"
+	invalids := []string{
+		"@file a.c main(0) @file_",
+		"@file a.c $main(0) @ok 2 @file_",
+		"@file a.c\n$main(0) @ok 2\n@file_",
+		"@file a.c @file_",
+		"@fiel a.c $main(0) @fiel_",
+		"@def $x\n1\n@def_",
+		"@matrix $t=[a]\n@fiel a.c $main($t) @fiel_\n@matrix_",
+		"@if 1\n@ok 2 @ok_\n@if_",
+	}
+
+	for _, content := range invalids {
+		sections := dirChildren(t, parser, "\n"+content, 1)
+		err := processDirSection(parser, dir, UNTAGGED, sections, 0, manifest.New())
+		templateErr, ok := err.(*Error)
+		if !ok {
+			t.Errorf("invalid section in @dir but error is not returned: %q(got=%v)", content, err)
+			continue
+		}
+
+		if templateErr.File != "test.tt" || templateErr.Line < 3 {
+			t.Errorf("error is not positioned at the section: %q(got=%s)", content, templateErr.Position())
+		}
+	}
+}
+
+func TestProcessDirSectionDuplicatedFile(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	parser.currentFile = "test.tt"
+	content := `@file a.c $main(0) @ok 2 @ok_ @file_
+@file b.c $main(0) @file_
+@if 1
+@file a.c $main(1) @file_
+@if_`
+	files := manifest.New()
+	sections := dirChildren(t, parser, content, 1)
+	err := processDirSection(parser, dir, UNTAGGED, sections, 0, files)
+	templateErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("duplicated file but template error is not returned(got=%v)", err)
+	}
+
+	expected := "duplicated file 'a.c'(previous @file is at test.tt:2)"
+	if templateErr.Line != 5 || templateErr.Column != 7 || templateErr.Message != expected {
+		t.Errorf("Expected '%s' at 5:7 but got '%s' at %d:%d",
+			expected, templateErr.Message, templateErr.Line, templateErr.Column)
+	}
+
+	if entry, ok := files.Lookup("a.c"); !ok || entry.Ok != 2 {
+		t.Error("manifest entry of the first @file is overwritten")
+	}
+
+	if got := readGeneratedFile(t, filepath.Join(dir, "a.c")); got != "int main(void) { return 0; }\n" {
+		t.Errorf("file of the first @file is overwritten(got=%s)", got)
+	}
+}
+
+func TestProcessDirSectionNoSpaceBeforeEnd(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	sections := dirChildren(t, parser, "@file a.c $main(0)@file_", 1)
+	if err := processDirSection(parser, dir, UNTAGGED, sections, 0, manifest.New()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readGeneratedFile(t, filepath.Join(dir, "a.c")); got != "int main(void) { return 0; }\n" {
+		t.Errorf("unexpected generated file(got=%s)", got)
+	}
+}
+
+func TestProcessDirSectionOkCount(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	content := `
+@file fn001.c $main(0) @ok 3 @ok_ @file_
+@file fn002.c $main(0) @file_
+`
+	files := manifest.New()
+	sections := dirChildren(t, parser, content, 1)
+	if err := processDirSection(parser, dir, UNTAGGED, sections, 0, files); err != nil {
+		t.Fatal(err)
+	}
+
+	if entry, ok := files.Lookup("fn001.c"); !ok || entry.Ok != 3 {
+		t.Error("'@ok' count is not recorded")
+	}
+
+	if entry, ok := files.Lookup("fn002.c"); !ok || entry.Ok != 1 {
+		t.Error("default '@ok' count should be 1")
+	}
+}
+
+func TestParseDefSection(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	if err := parseDefSection(parser, &Section{Arg: " $add($a, $b) ", Content: "\n$a + $b\n"}); err != nil {
+		t.Fatal(err)
+	}
+
+	m, ok := parser.environment()["$add"]
+	if !ok {
+		t.Fatal("'$add' is not defined")
+	}
+
+	if m.Body != "$a + $b" {
+		t.Errorf("unexpected macro body(got=%s)", m.Body)
+	}
+
+	if len(m.DummyArgs) != 2 || m.DummyArgs[0] != "$a" || m.DummyArgs[1] != "$b" {
+		t.Errorf("unexpected dummy arguments(got=%v)", m.DummyArgs)
+	}
+
+	if err := parseDefSection(parser, &Section{Arg: "$zero", Content: "0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if m := parser.environment()["$zero"]; m == nil || len(m.DummyArgs) != 0 {
+		t.Error("macro without arguments is not defined")
+	}
+}
+
+func TestParseDefSectionComment(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	parser.currentFile = "test.tt"
+	text := "@def $m($a)\nint x = $a;\n@comment\nhello\n@comment_\n@comment ignored @comment_\nint y;\n@def_\n"
+	if err := parseDefSection(parser, readSection(t, parser, text, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if body := parser.environment()["$m"].Body; body != "int x = $a;\nint y;" {
+		t.Errorf("comment in macro body is not removed(got=%q)", body)
+	}
+
+	text = "@def $n\n1\n@dir d\n@dir_\n@def_\n"
+	err := parseDefSection(parser, readSection(t, parser, text, 1))
+	templateErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("nested section in @def but template error is not returned(got=%v)", err)
+	}
+
+	if templateErr.Line != 3 {
+		t.Errorf("Expected error at line 3 but got %s", templateErr.Position())
+	}
+}
+
+func TestParseDefSectionVariadic(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	if err := parseDefSection(parser, &Section{Arg: "$check($type, $n = 1, $vals...)", Content: "$type $n $vals"}); err != nil {
+		t.Fatal(err)
+	}
+
+	m := parser.environment()["$check"]
+	if !m.Variadic || len(m.DummyArgs) != 3 || m.DummyArgs[2] != "$vals" {
+		t.Errorf("variadic argument is not parsed(got=%v)", m.DummyArgs)
+	}
+
+	if m.Defaults["$n"] != "1" || len(m.Defaults) != 1 {
+		t.Errorf("default argument is not parsed(got=%v)", m.Defaults)
+	}
+
+	got, err := m.Evaluate([]string{"int"}, parser.environment())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != "int 1 " {
+		t.Errorf("Expected 'int 1 ' but got '%s'", got)
+	}
+}
+
+func TestParseDefSectionDefaultWithComma(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+	macro.RegisterBuiltins(parser.environment())
+
+	if err := parseDefSection(parser, &Section{Arg: `$m($x, $y=$if(1, a, b), $z = "c, d")`, Content: "$x $y $z"}); err != nil {
+		t.Fatal(err)
+	}
+
+	m := parser.environment()["$m"]
+	if len(m.DummyArgs) != 3 || m.DummyArgs[1] != "$y" || m.DummyArgs[2] != "$z" {
+		t.Errorf("unexpected dummy arguments(got=%v)", m.DummyArgs)
+	}
+
+	if m.Defaults["$y"] != "$if(1, a, b)" || m.Defaults["$z"] != `"c, d"` {
+		t.Errorf("default arguments with comma are not parsed(got=%v)", m.Defaults)
+	}
+
+	got, err := m.Evaluate([]string{"x"}, parser.environment())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != `x a "c, d"` {
+		t.Errorf(`Expected 'x a "c, d"' but got '%s'`, got)
+	}
+}
+
+func TestParseDefSectionInvalid(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	invalids := []string{"name", "$f($a, b)", "$f($a, $a)", "$f $g",
+		"$f($a..., $b)", "$f($a=1, $b)", "$f($a..., $a)"}
+	for _, arg := range invalids {
+		if err := parseDefSection(parser, &Section{Arg: arg, Content: "body"}); err == nil {
+			t.Errorf("invalid definition '%s' but error is not returned", arg)
+		}
+	}
+}
+
+func TestParseDefSectionRedefinition(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	var warnings bytes.Buffer
+	parser.Warnings = &warnings
+
+	if err := parseDefSection(parser, &Section{Arg: "$main", Content: "int main(void) {}"}); err == nil {
+		t.Error("predefined macro is redefined but error is not returned")
+	}
+
+	if err := parseDefSection(parser, &Section{Arg: "$v", Content: "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := parseDefSection(parser, &Section{Arg: "$v", Content: "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if warnings.Len() != 0 {
+		t.Errorf("same redefinition should not be warned(got=%s)", warnings.String())
+	}
+
+	if err := parseDefSection(parser, &Section{Arg: "$v", Content: "2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(warnings.String(), "'$v' is redefined") {
+		t.Errorf("redefinition is not warned(got=%s)", warnings.String())
+	}
+
+	if parser.environment()["$v"].Body != "2" {
+		t.Error("macro is not redefined")
+	}
+}
+
+func TestDefinedMacroScope(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	if err := parseDefSection(parser, &Section{Arg: "$test($v)", Content: "int main(void) { return $v; }"}); err != nil {
+		t.Fatal(err)
+	}
+
+	sections := dirChildren(t, parser, `@file a.c $test(1) @file_`, 1)
+	if err := processDirSection(parser, dir, UNTAGGED, sections, 0, manifest.New()); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readGeneratedFile(t, filepath.Join(dir, "a.c"))
+	if got != "int main(void) { return 1; }\n" {
+		t.Errorf("defined macro is not expanded(got=%s)", got)
+	}
+
+	parser.resetEnvironment()
+	if _, ok := parser.environment()["$test"]; ok {
+		t.Error("defined macro is visible from other template")
+	}
+
+	if _, ok := parser.environment()["$main"]; !ok {
+		t.Error("predefined macro should be visible from any template")
+	}
+}
+
+func TestExpandFilename(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	parser.SetFilenameIndex(9)
+
+	expected := []string{"fn009_extern.c", "plain.c", "fn010_10.c"}
+	names := []string{"fn???_extern.c", "plain.c", "fn???_??.c"}
+	for i, name := range names {
+		got, err := parser.expandFilename(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != expected[i] {
+			t.Errorf("Expected '%s' but got '%s'", expected[i], got)
+		}
+	}
+}
+
+func TestExpandFilenameOverflow(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	parser.SetFilenameIndex(99)
+	if _, err := parser.expandFilename("fn??.c"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := parser.expandFilename("fn??.c"); err == nil {
+		t.Error("filename index overflows but error is not returned")
+	}
+}
+
+func TestProcessDirSectionSkip(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	parser.Skip = FLOAT_TEST
+
+	content := `
+@file int???.c $main(0) @file_
+@file:float float???.c $main(0) @file_
+@file:int int???.c $main(0) @file_
+`
+	sections := dirChildren(t, parser, content, 1)
+	if err := processDirSection(parser, dir, FLOAT_TEST, sections, 0, manifest.New()); err != nil {
+		t.Fatal(err)
+	}
+
+	if parser.Skipped() != 2 {
+		t.Errorf("Expected 2 skipped files but got %d", parser.Skipped())
+	}
+
+	for _, name := range []string{"int000.c", "float001.c"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("'%s' should be skipped", name)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "int002.c")); err != nil {
+		t.Error("'int002.c' is not generated")
+	}
+}
+
+func TestProcessDirSectionUnknownCategory(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	content := `@file:double a.c $main(0) @file_`
+	sections := dirChildren(t, parser, content, 1)
+	if err := processDirSection(parser, dir, UNTAGGED, sections, 0, manifest.New()); err == nil {
+		t.Error("unknown category but error is not returned")
+	}
+}
+
+func TestProcessDirSectionRecursiveMacro(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	if err := parseDefSection(parser, &Section{Arg: "$a", Content: "$b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := parseDefSection(parser, &Section{Arg: "$b", Content: "$a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	parser.currentFile = "test.tt"
+
+	content := `
+@comment
+@comment_
+@file a.c $a() @file_
+`
+	sections := dirChildren(t, parser, content, 10)
+	err := processDirSection(parser, dir, UNTAGGED, sections, 0, manifest.New())
+	if err == nil {
+		t.Fatal("recursive macro is expanded but error is not returned")
+	}
+
+	expected := "test.tt:14:11: a.c: recursive macro expansion: $a -> $b -> $a"
+	if err.Error() != expected {
+		t.Errorf("Expected '%s' but got '%s'", expected, err.Error())
+	}
+
+	var expansionErr *macro.ExpansionError
+	if !errors.As(err, &expansionErr) {
+		t.Errorf("original error is not wrapped(got=%#v)", err)
+	}
+}
+
+func TestProcessDirSectionMacroArgument(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	parser.predefined["$INTMAX"] = &macro.Macro{Name: "$INTMAX", Body: "2147483647"}
+
+	content := `@file a.c $main($INTMAX) @file_`
+	sections := dirChildren(t, parser, content, 1)
+	if err := processDirSection(parser, dir, UNTAGGED, sections, 0, manifest.New()); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readGeneratedFile(t, filepath.Join(dir, "a.c"))
+	if got != "int main(void) { return 2147483647; }\n" {
+		t.Errorf("macro in argument is not expanded(got=%s)", got)
+	}
+}
+
+func TestProcessDirSectionLiteralMacro(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	body := "#include <stdio.h>\nint main(void) { puts(\"@OK@\"); return 0; }"
+	if err := parseDefSection(parser, &Section{Arg: "$hello", Content: body}); err != nil {
+		t.Fatal(err)
+	}
+
+	content := `@file hello.c $hello() @file_`
+	sections := dirChildren(t, parser, content, 1)
+	if err := processDirSection(parser, dir, UNTAGGED, sections, 0, manifest.New()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readGeneratedFile(t, filepath.Join(dir, "hello.c")); got != body+"\n" {
+		t.Errorf("plain text macro body is not generated(got=%s)", got)
+	}
+}
+
+func TestProcessDirSectionMatrix(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	parser.predefined["$TYPES"] = &macro.Macro{Name: "$TYPES", Body: "char, unsigned long"}
+	if err := parseDefSection(parser, &Section{Arg: "$conv($from, $to)", Content: "($to)($from)0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	content := `@file first.c $main(0) @file_
+@matrix $from=$TYPES $to=[int, long long]
+@file conv.c $conv($from, $to) @file_
+@matrix_
+@file last.c $main(1) @file_
+`
+	files := manifest.New()
+	sections := dirChildren(t, parser, content, 1)
+	if err := processDirSection(parser, dir, UNTAGGED, sections, 0, files); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		name    string
+		content string
+	}{
+		{"first.c", "int main(void) { return 0; }\n"},
+		{"conv000.c", "(int)(char)0\n"},
+		{"conv001.c", "(long long)(char)0\n"},
+		{"conv002.c", "(int)(unsigned long)0\n"},
+		{"conv003.c", "(long long)(unsigned long)0\n"},
+		{"last.c", "int main(void) { return 1; }\n"},
+	}
+
+	if len(files.Entries) != len(expected) {
+		t.Fatalf("Expected %d files but got %v", len(expected), files.Entries)
+	}
+
+	for i, e := range expected {
+		if files.Entries[i].File != e.name {
+			t.Errorf("Expected '%s' but got '%s'", e.name, files.Entries[i].File)
+		}
+
+		if got := readGeneratedFile(t, filepath.Join(dir, e.name)); got != e.content {
+			t.Errorf("%s: Expected '%s' but got '%s'", e.name, e.content, got)
+		}
+	}
+
+	if _, ok := parser.environment()["$from"]; ok {
+		t.Error("@matrix variable should not be visible after @matrix section")
+	}
+}
+
+func TestProcessDirSectionLargeMatrix(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	parser.SetFilenameIndex(5)
+	values := "[0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10]"
+	content := "@file first???.c $main(0) @file_\n" +
+		"@matrix $a=" + values + " $b=" + values + " $c=" + values + "\n" +
+		"@file conv.c $main($a + $b + $c) @file_\n" +
+		"@matrix_\n"
+	files := manifest.New()
+	sections := dirChildren(t, parser, content, 1)
+	if err := processDirSection(parser, dir, UNTAGGED, sections, 0, files); err != nil {
+		t.Fatal(err)
+	}
+
+	// 11 * 11 * 11 files are numbered from 6
+	if len(files.Entries) != 1+1331 {
+		t.Fatalf("Expected %d files but got %d", 1+1331, len(files.Entries))
+	}
+
+	for _, name := range []string{"first005.c", "conv0006.c", "conv1336.c"} {
+		if _, ok := files.Lookup(name); !ok {
+			t.Errorf("'%s' is not generated", name)
+		}
+	}
+
+	if got := readGeneratedFile(t, filepath.Join(dir, "conv1336.c")); got != "int main(void) { return 10 + 10 + 10; }\n" {
+		t.Errorf("unexpected last file of @matrix(got=%s)", got)
+	}
+}
+
+func TestProcessDirSectionMatrixInvalid(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	invalids := []string{
+		"@matrix\n@file a.c $main(0) @file_\n@matrix_\n",
+		"@matrix $t=int\n@file a.c $main($t) @file_\n@matrix_\n",
+		"@matrix $t=[] \n@file a.c $main($t) @file_\n@matrix_\n",
+		"@matrix $t=[a] $t=[b]\n@file a.c $main($t) @file_\n@matrix_\n",
+		"@matrix $main=[a]\n@file a.c $main(0) @file_\n@matrix_\n",
+	}
+
+	for _, content := range invalids {
+		sections := dirChildren(t, parser, content, 1)
+		if err := processDirSection(parser, dir, UNTAGGED, sections, 0, manifest.New()); err == nil {
+			t.Errorf("invalid @matrix but error is not returned: %q", content)
+		}
+	}
+}
+
+func TestProcessDirSectionNestedIf(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	parser.predefined["$LONG"] = &macro.Macro{Name: "$LONG", Body: "64"}
+	parser.predefined["$LANG"] = &macro.Macro{Name: "$LANG", Body: `"c"`}
+
+	content := `@file a.c $main(0) @file_
+@if $LONG == 64
+@file b.c $main(0) @file_
+@if $LANG != "c"
+@file c.c $main(0) @file_
+@else
+@file d.c $main(0) @file_
+@if_
+@else
+@file e.c $main(0) @file_
+@if $UNDEFINED
+@if_
+@if_
+@file f.c $main(0) @file_`
+	files := manifest.New()
+	sections := dirChildren(t, parser, content, 1)
+	if err := processDirSection(parser, dir, UNTAGGED, sections, 0, files); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"a.c", "b.c", "d.c", "f.c"}
+	if len(files.Entries) != len(expected) {
+		t.Fatalf("Expected %v but got %v", expected, files.Entries)
+	}
+
+	for i, name := range expected {
+		if files.Entries[i].File != name {
+			t.Errorf("Expected '%s' but got '%s'", name, files.Entries[i].File)
+		}
+	}
+
+	invalids := []string{"@if $LANG\n@if_", "@if  1 +\n@if_"}
+	for _, content := range invalids {
+		sections := dirChildren(t, parser, content, 1)
+		err := processDirSection(parser, dir, UNTAGGED, sections, 0, manifest.New())
+		templateErr, ok := err.(*Error)
+		if !ok {
+			t.Errorf("invalid conditional but error is not returned: %q(got=%v)", content, err)
+			continue
+		}
+
+		// condition starts with '$' or '1'
+		if templateErr.Line != 2 || templateErr.Column != strings.IndexAny(content, "$1")+1 {
+			t.Errorf("condition is not pointed: %q(got=%d:%d)", content, templateErr.Line, templateErr.Column)
+		}
+	}
+}
+
+func TestProcessDirSectionIf(t *testing.T) {
+	parser, dir := testParser(t)
+	defer os.RemoveAll(dir)
+
+	parser.predefined["$LONG"] = &macro.Macro{Name: "$LONG", Body: "32"}
+
+	content := `@if $LONG == 64
+@file long.c $main(64) @file_
+@else
+@file long.c $main(32) @file_
+@if_
+`
+	files := manifest.New()
+	sections := dirChildren(t, parser, content, 1)
+	if err := processDirSection(parser, dir, UNTAGGED, sections, 0, files); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files.Entries) != 1 {
+		t.Fatalf("Expected only one file but got %v", files.Entries)
+	}
+
+	if got := readGeneratedFile(t, filepath.Join(dir, "long.c")); got != "int main(void) { return 32; }\n" {
+		t.Errorf("'@else' branch is not generated(got=%s)", got)
 	}
 }